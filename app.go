@@ -1,14 +1,15 @@
 package main
 
 import (
-	"encoding/json"
-	"io"
+	"context"
+	"fmt"
 	"log"
 	"net/http"
 	"regexp"
 	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/bluele/gcache"
 	"github.com/boltdb/bolt"
@@ -17,22 +18,78 @@ import (
 )
 
 type App struct {
-	db        *bolt.DB
-	apiHost   string
-	userAgent string
-	outbox    chan tgbotapi.Chattable
-	rts       map[TgUserID]*Realtime
-	rtLk      sync.Mutex
-	cache     gcache.Cache
+	db         *bolt.DB
+	bot        BotTransport
+	keys       *Keyring // ключ шифрования токенов; nil — токены хранятся открыто
+	apiHost    string
+	apiScheme  string        // "https"; для локального сервера можно "http"
+	httpClient *http.Client  // для основного инстанса и файлов Telegram; nil — http.DefaultClient
+	apiTimeout time.Duration // ограничение времени одного запроса к API
+	userAgent  string
+	outbox     chan tgbotapi.Chattable
+	rts        map[rtKey]*Realtime  // подписки пользователей
+	conns      map[string]*Realtime // соединения, по connKey
+	rtLimit    int                  // не больше стольких соединений; 0 — без ограничения
+	polled     []*polledAccount     // подписки, которым не хватило соединений
+	pollNext   int
+	rtLk       sync.Mutex
+	dialSem    chan struct{} // ограничивает число одновременных подключений
+	cache      gcache.Cache
+	ignored    map[string]int // счётчики проигнорированных типов обновлений
+	ignoredLk  sync.Mutex
+	authLk     sync.Mutex // обработка отвергнутых токенов
+	ops        operations // выполняющиеся операции пользователей
 }
 
 func (a *App) SendText(chatID TgUserID, text string) { a.outbox <- tgbotapi.NewMessage(chatID, text) }
 
-func (a *App) testToken(token string) (*frf.User, error) {
-	user := &frf.User{AccessToken: strings.TrimSpace(token)}
+// SendAttachments отправляет аттачменты поста: картинки — как фото или альбомы, остальное — как документы
+func (a *App) SendAttachments(chatID TgUserID, atts []*frf.Attachment) {
+	const maxAlbumSize = 10
 
-	v := new(frf.DirectChannelResponse)
-	err := a.SendRequest(user, "GET", "/v2/timelines/filter/directs?offset=0", nil, v)
+	var images []*frf.Attachment
+	for _, att := range atts {
+		if att.IsImage() {
+			images = append(images, att)
+		}
+	}
+
+	for len(images) > 0 {
+		n := len(images)
+		if n > maxAlbumSize {
+			n = maxAlbumSize
+		}
+		if n == 1 {
+			a.outbox <- tgbotapi.NewPhotoShare(chatID, images[0].URL)
+		} else {
+			media := make([]interface{}, n)
+			for i, att := range images[:n] {
+				media[i] = tgbotapi.NewInputMediaPhoto(att.URL)
+			}
+			a.outbox <- tgbotapi.NewMediaGroup(chatID, media)
+		}
+		images = images[n:]
+	}
+
+	for _, att := range atts {
+		if !att.IsImage() {
+			a.outbox <- tgbotapi.NewDocumentShare(chatID, att.URL)
+		}
+	}
+}
+
+// hostOf возвращает хост инстанса FreeFeed, к которому относится аккаунт
+func (a *App) hostOf(user *frf.User) string {
+	if user != nil && user.Host != "" {
+		return user.Host
+	}
+	return a.apiHost
+}
+
+func (a *App) testToken(ctx context.Context, host string, token string) (*frf.User, error) {
+	user := &frf.User{AccessToken: strings.TrimSpace(token), Host: host}
+
+	v, err := a.api(user).Directs(ctx, 0)
 	if err != nil {
 		return nil, err
 	}
@@ -57,16 +114,69 @@ func (a *App) testToken(token string) (*frf.User, error) {
 	return user, nil
 }
 
-func (a *App) sendDirect(user *frf.User, addressees []string, text string) (string, error) {
-	postBody := &frf.NewPostRequest{}
-	postBody.Meta.Feeds = addressees
-	postBody.Post.Body = text
-	v := &frf.PostResponse{}
+func (a *App) sendDirect(ctx context.Context, user *frf.User, addressees []string, text string, attachments []string) (string, error) {
+	return a.api(user).CreatePost(ctx, addressees, text, attachments)
+}
+
+// tgFileTimeout ограничивает скачивание файла из Telegram (боту доступны файлы до 20 МБ).
+// Файл сразу передаётся во FreeFeed, так что это ограничение и на всю загрузку.
+const tgFileTimeout = 10 * time.Minute
 
-	if err := a.SendRequest(user, "POST", "/v1/posts", postBody, v); err != nil {
+// uploadTgFile скачивает файл из Telegram и загружает его во FreeFeed как аттачмент
+func (a *App) uploadTgFile(ctx context.Context, user *frf.User, fileID string, fileName string) (string, error) {
+	fileURL, err := a.bot.GetFileDirectURL(fileID)
+	if err != nil {
 		return "", err
 	}
-	return v.Posts.ID, nil
+
+	ctx, cancel := context.WithTimeout(ctx, tgFileTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", fileURL, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := a.client().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("can not download file from Telegram: %s", resp.Status)
+	}
+
+	return a.api(user).UploadAttachment(ctx, fileName, resp.Body)
+}
+
+// uploadMsgAttachments загружает во FreeFeed фото или документ из сообщения
+func (a *App) uploadMsgAttachments(ctx context.Context, user *frf.User, msg *tgbotapi.Message) ([]string, error) {
+	var fileID, fileName string
+	if msg.Photo != nil && len(*msg.Photo) > 0 {
+		// последний размер — самый большой
+		photos := *msg.Photo
+		fileID = photos[len(photos)-1].FileID
+		fileName = "photo.jpg"
+	} else if msg.Document != nil {
+		fileID = msg.Document.FileID
+		fileName = msg.Document.FileName
+		if fileName == "" {
+			fileName = "file"
+		}
+	} else {
+		return nil, nil
+	}
+
+	attID, err := a.uploadTgFile(ctx, user, fileID, fileName)
+	if err != nil {
+		return nil, err
+	}
+	return []string{attID}, nil
+}
+
+// hasAttachments проверяет, есть ли в сообщении фото или документ
+func hasAttachments(msg *tgbotapi.Message) bool {
+	return (msg.Photo != nil && len(*msg.Photo) > 0) || msg.Document != nil
 }
 
 var toRe = regexp.MustCompile(`^\s*([a-zA-Z0-9]{3,25})\s+(.+?)\s*$`)
@@ -77,9 +187,8 @@ type contactTask struct {
 	List []string
 }
 
-func (a *App) getContacts(user *frf.User) ([]string, error) {
-	v := &frf.WhoAmIResponse{}
-	err := a.SendRequest(user, "GET", "/v2/users/whoami", nil, v)
+func (a *App) getContacts(ctx context.Context, user *frf.User) ([]string, error) {
+	v, err := a.api(user).WhoAmI(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -99,74 +208,69 @@ func (a *App) getContacts(user *frf.User) ([]string, error) {
 	return names, nil
 }
 
-func (a *App) getAllPosts(user *frf.User) ([]*frf.Post, error) {
-	v := &frf.DirectChannelResponse{}
-	err := a.SendRequest(user, "GET", "/v2/timelines/filter/directs?offset=0", nil, v)
-	if err != nil {
-		return nil, err
-	}
-	return v.AllPosts(), nil
+func (a *App) directsPager(ctx context.Context, user *frf.User, offset int) *frf.DirectsPager {
+	return a.api(user).Pager(ctx, offset)
 }
 
-func (a *App) getPost(user *frf.User, shortCode string) (*frf.Post, error) {
-	posts, err := a.getAllPosts(user)
-	if err != nil {
-		return nil, err
-	}
+// максимальное количество страниц, просматриваемых при поиске поста по короткому коду
+const maxSearchPages = 10
 
-	for _, p := range posts {
-		if strings.HasPrefix(p.ID, shortCode) {
-			return p, nil
+func (a *App) getPost(ctx context.Context, user *frf.User, shortCode string) (*frf.Post, error) {
+	pager := a.directsPager(ctx, user, 0)
+	for i := 0; i < maxSearchPages && !pager.Done; i++ {
+		posts, err := pager.Next()
+		if err != nil {
+			return nil, err
 		}
-	}
 
-	return nil, ErrNotFound
-}
-
-func (a *App) getPostByID(user *frf.User, postID string) (*frf.Post, error) {
-	v := &frf.OnePostResponse{}
-	err := a.SendRequest(user, "GET", "/v2/posts/"+postID, nil, v)
-	if err != nil {
-		return nil, err
+		for _, p := range posts {
+			if strings.HasPrefix(p.ID, shortCode) {
+				return p, nil
+			}
+		}
 	}
-	return v.GetPost(), nil
+
+	return nil, frf.ErrNotFound
 }
 
-type requestSigner interface {
-	Sign(*http.Request) *http.Request
+func (a *App) getPostByID(ctx context.Context, user *frf.User, postID string) (*frf.Post, error) {
+	return a.api(user).GetPost(ctx, postID)
 }
 
-func (a *App) SendRequest(u requestSigner, method string, uri string, reqObj interface{}, respObj interface{}) error {
-	url := "https://" + a.apiHost + uri
-	var req *http.Request
-	if reqObj == nil {
-		req, _ = http.NewRequest(method, url, nil)
-	} else {
-		r, w := io.Pipe()
-		go func() { json.NewEncoder(w).Encode(reqObj); w.Close() }()
-		req, _ = http.NewRequest(method, url, r)
-		req.Header.Add("Content-Type", "application/json; charset=utf-8")
-	}
-	if a.userAgent != "" {
-		req.Header.Set("User-Agent", a.userAgent)
+func (a *App) baseURL(host string) string {
+	if a.apiScheme == "" {
+		return "https://" + host
 	}
-	u.Sign(req)
+	return a.apiScheme + "://" + host
+}
 
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return err
+// rtURL возвращает адрес realtime-сервера: если API работает по http, то и realtime — без TLS
+func (a *App) rtURL(host string) string {
+	if a.apiScheme == "http" {
+		return "ws://" + host
 	}
-	defer resp.Body.Close()
+	return "wss://" + host
+}
 
-	if resp.StatusCode != http.StatusOK {
-		err := frf.ReadErrorResponse(resp)
-		log.Println("Error:", err, "while send", method, "request to", url)
-		return err
+func (a *App) client() *http.Client {
+	if a.httpClient != nil {
+		return a.httpClient
 	}
+	return http.DefaultClient
+}
 
-	if respObj != nil {
-		return json.NewDecoder(resp.Body).Decode(respObj)
+// api возвращает клиент API FreeFeed от имени пользователя user
+func (a *App) api(user *frf.User) *frf.Client {
+	c := frf.NewClient(a.baseURL(a.hostOf(user)), user)
+	c.HTTPClient = a.hostClient(a.hostOf(user))
+	c.Timeout = a.apiTimeout
+	c.UserAgent = a.userAgent
+	c.OnUnauthorized = func(ctx context.Context) {
+		if userID, ok := ownerOf(ctx); ok {
+			a.AuthFailed(userID, user)
+		} else {
+			log.Println("Token of", user.Name, "is rejected outside of user operation")
+		}
 	}
-
-	return nil
+	return c
 }
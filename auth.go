@@ -0,0 +1,55 @@
+package main
+
+import (
+	"log"
+
+	"github.com/davidmz/FreefeedDirectBot/frf"
+)
+
+// AuthFailed вызывается, когда FreeFeed отверг токен аккаунта user пользователя userID
+// (401 от API или от realtime-сервера). Аккаунт помечается недействительным, его
+// realtime-соединение останавливается, а пользователю один раз приходит просьба прислать новый токен.
+func (a *App) AuthFailed(userID TgUserID, user *frf.User) {
+	a.authLk.Lock()
+	defer a.authLk.Unlock()
+
+	user.Invalid = true
+	state := a.LoadState(userID)
+	account := state.accountByToken(a.hostOf(user), user.AccessToken)
+	if account == nil {
+		// проверка токена, который ещё не сохранён
+		return
+	}
+	a.StopRT(userID, account)
+	if account.Invalid {
+		return
+	}
+	log.Println("Token of", userID, account.Name, "is rejected")
+
+	account.Invalid = true
+	if state.Action != ActNothing && state.Action != ActNewToken {
+		// не прерываем то, что пользователь сейчас делает: новый токен он подключит сам
+		a.SaveState(state)
+		addCmd := "/add"
+		if account.Host != a.apiHost {
+			addCmd += " " + account.Host
+		}
+		a.SendText(userID, ReauthLaterMessage(account.Name, account.Host, addCmd))
+		return
+	}
+	st := state.Clone(ActNewToken)
+	st.Host = account.Host
+	// следующий токен заменит отвергнутый, поэтому делаем аккаунт активным
+	st.UseAccount(account.Host, account.Name)
+	a.SaveState(st)
+	a.SendText(userID, ReauthMessage(account.Name, account.Host))
+}
+
+func (s *State) accountByToken(host, token string) *frf.User {
+	for _, u := range s.Accounts {
+		if u.Host == host && u.AccessToken == token {
+			return u
+		}
+	}
+	return nil
+}
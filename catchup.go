@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/davidmz/FreefeedDirectBot/frf"
+)
+
+var WatermarksBucket = []byte("Watermarks")
+
+// Водяной знак — время (в миллисекундах, по часам сервера FreeFeed) последнего поста
+// или комментария, о котором знает бот. Хранится для каждого аккаунта каждого пользователя.
+// У аккаунтов инстанса по умолчанию ключ без хоста, как до появления нескольких инстансов.
+func (a *App) watermarkKey(userID TgUserID, account *frf.User) []byte {
+	key := strconv.FormatInt(userID, 10) + "/"
+	if host := a.hostOf(account); host != a.apiHost {
+		key += host + "/"
+	}
+	return []byte(key + account.Name)
+}
+
+func (a *App) Watermark(userID TgUserID, account *frf.User) (ts int64) {
+	a.db.View(func(tx *bolt.Tx) error {
+		ts, _ = strconv.ParseInt(string(tx.Bucket(WatermarksBucket).Get(a.watermarkKey(userID, account))), 10, 64)
+		return nil
+	})
+	return
+}
+
+// AdvanceWatermark сдвигает водяной знак вперёд (назад он не двигается никогда)
+func (a *App) AdvanceWatermark(userID TgUserID, account *frf.User, ts int64) {
+	if ts == 0 {
+		return
+	}
+	a.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(WatermarksBucket)
+		key := a.watermarkKey(userID, account)
+		if old, _ := strconv.ParseInt(string(b.Get(key)), 10, 64); old >= ts {
+			return nil
+		}
+		return b.Put(key, []byte(strconv.FormatInt(ts, 10)))
+	})
+}
+
+func (a *App) ForgetWatermark(userID TgUserID, account *frf.User) {
+	a.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(WatermarksBucket).Delete(a.watermarkKey(userID, account))
+	})
+}
+
+type missedEvent struct {
+	at      int64
+	post    *frf.Post
+	comment *frf.Comment // nil, если пропущен сам пост
+}
+
+// CatchUp присылает посты и комментарии, появившиеся после водяного знака since, пока бот
+// был выключен или realtime-соединение было разорвано. Вызывается при каждом подключении;
+// since берётся до подписки, чтобы события, пришедшие раньше ответа на неё, не сдвинули его.
+func (a *App) CatchUp(ctx context.Context, userID TgUserID, user *frf.User, since int64) {
+	ctx = withOwner(ctx, userID)
+	state := a.LoadState(userID)
+	account := state.Account(a.hostOf(user), user.Name)
+	if account == nil || state.Paused && since == 0 {
+		return
+	}
+	// директы, привязанные к группам: пропущенные комментарии к ним пересылаются в группы,
+	// даже если пользователь заблокировал бота
+	bound := make(map[string]bool)
+	for _, g := range a.findGroups(func(g *groupBinding) bool { return g.ownedBy(userID, account) }) {
+		bound[g.PostID] = true
+	}
+	if state.Paused && len(bound) == 0 {
+		return
+	}
+
+	pager := a.directsPager(ctx, account, 0)
+	latest := since
+
+	if since == 0 {
+		// первое подключение: догонять нечего, только запоминаем, докуда дочитано
+		posts, err := pager.Next()
+		if err != nil {
+			log.Println("Can not load directs of", userID, account.Name, err)
+			return
+		}
+		for _, p := range posts {
+			latest = maxInt64(latest, p.CreatedAt, p.BumpedAt)
+		}
+		if latest == 0 {
+			latest = time.Now().UnixNano() / int64(time.Millisecond)
+		}
+		a.AdvanceWatermark(userID, account, latest)
+		return
+	}
+
+	var missed []*missedEvent
+	// лента директов упорядочена по времени последней активности
+	for i, stop := 0, false; i < maxSearchPages && !pager.Done && !stop; i++ {
+		posts, err := pager.Next()
+		if err != nil {
+			log.Println("Can not load directs of", userID, account.Name, err)
+			return
+		}
+		for _, p := range posts {
+			if maxInt64(p.CreatedAt, p.BumpedAt) <= since {
+				stop = true
+				break
+			}
+			latest = maxInt64(latest, p.CreatedAt, p.BumpedAt)
+
+			notify := !state.Paused
+			if notify && p.CreatedAt > since && state.Account(account.Host, p.Author) == nil && !a.alreadyNotified("post", userID, p.ID) {
+				missed = append(missed, &missedEvent{at: p.CreatedAt, post: p})
+			}
+			if notify && a.IsMuted(userID, p.ID) {
+				notify = false
+			}
+			if p.BumpedAt <= since || !notify && !bound[p.ID] {
+				continue
+			}
+			thread, err := a.getThread(ctx, account, p.ID)
+			if err != nil {
+				log.Println("Can not load post", p.ID, err)
+				continue
+			}
+			for _, c := range thread.Comments {
+				if c.CreatedAt <= since {
+					continue
+				}
+				if bound[p.ID] {
+					a.forwardToGroups(userID, account, p.ID, c)
+				}
+				if notify && state.Account(account.Host, c.Author) == nil && !a.alreadyNotified("comm", userID, c.ID) {
+					missed = append(missed, &missedEvent{at: c.CreatedAt, post: thread, comment: c})
+				}
+				latest = maxInt64(latest, c.CreatedAt)
+			}
+		}
+	}
+
+	if state.Paused {
+		// уведомления и отметка «дочитано» ждут возвращения пользователя
+		return
+	}
+
+	if len(missed) > 0 {
+		sort.SliceStable(missed, func(i, j int) bool { return missed[i].at < missed[j].at })
+		a.SendText(userID, accountTag(state, account)+"⏳ Пока вас не было, пришло сообщений: "+strconv.Itoa(len(missed)))
+		for _, e := range missed {
+			if e.comment != nil {
+				a.notifyComment(state, account, e.post, e.comment)
+			} else {
+				a.notifyPost(state, account, e.post)
+			}
+		}
+	}
+	a.AdvanceWatermark(userID, account, latest)
+}
+
+// alreadyNotified проверяет, присылалось ли недавно уведомление (kind — "post" или "comm")
+func (a *App) alreadyNotified(kind string, userID TgUserID, id string) bool {
+	_, err := a.cache.Get(kind + ":" + strconv.FormatInt(userID, 10) + ":" + id)
+	return err == nil
+}
+
+func maxInt64(x int64, ys ...int64) int64 {
+	for _, y := range ys {
+		if y > x {
+			x = y
+		}
+	}
+	return x
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+func (a *App) HandleCallback(ctx context.Context, cq *tgbotapi.CallbackQuery) {
+	state := a.LoadState(TgUserID(cq.From.ID))
+
+	answer := ""
+	defer func() { a.bot.AnswerCallbackQuery(tgbotapi.NewCallback(cq.ID, answer)) }()
+
+	if !state.IsAuthorized() {
+		answer = "Сначала задайте токен командой /start"
+		return
+	}
+
+	switch data := cq.Data; {
+
+	case strings.HasPrefix(data, cbReply):
+		if cq.Message != nil {
+			a.switchToMessageAccount(state, cq.Message.Chat.ID, cq.Message.MessageID)
+		}
+		post, err := a.getPostByID(ctx, state.User, strings.TrimPrefix(data, cbReply))
+		if err != nil {
+			answer = "Сообщение не найдено."
+		} else {
+			a.startComment(state, post)
+		}
+
+	case strings.HasPrefix(data, cbThread):
+		if cq.Message != nil {
+			a.switchToMessageAccount(state, cq.Message.Chat.ID, cq.Message.MessageID)
+		}
+		a.SendThread(ctx, state, strings.TrimPrefix(data, cbThread))
+
+	case strings.HasPrefix(data, cbTo):
+		a.addAddressee(state, strings.TrimPrefix(data, cbTo))
+
+	case strings.HasPrefix(data, cbMute), strings.HasPrefix(data, cbUnmute):
+		muted := strings.HasPrefix(data, cbMute)
+		postID := strings.TrimPrefix(strings.TrimPrefix(data, cbMute), cbUnmute)
+		a.SetMuted(state.UserID, postID, muted)
+		if muted {
+			answer = "Больше не буду присылать комментарии к этому сообщению."
+		} else {
+			answer = "Снова буду присылать комментарии к этому сообщению."
+		}
+		if cq.Message != nil {
+			if post, err := a.getPostByID(ctx, state.User, postID); err == nil {
+				a.outbox <- tgbotapi.NewEditMessageReplyMarkup(cq.Message.Chat.ID, cq.Message.MessageID,
+					a.postKeyboard(state.UserID, a.hostOf(state.User), post.Author, post.ID))
+			}
+		}
+
+	case data == cbRead:
+		if cq.Message != nil {
+			a.switchToMessageAccount(state, cq.Message.Chat.ID, cq.Message.MessageID)
+		}
+		if err := a.api(state.User).MarkAllDirectsAsRead(ctx); err != nil {
+			answer = "Что-то пошло не так: " + errText(err)
+		} else {
+			answer = "Все директы отмечены прочитанными."
+		}
+	}
+}
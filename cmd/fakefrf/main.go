@@ -0,0 +1,84 @@
+// Команда fakefrf запускает локальный сервер FreeFeed в памяти, чтобы проверять бота без freefeed.net:
+//
+//	go run ./cmd/fakefrf -addr localhost:3000 -users alice,bob
+//	FreefeedDirectBot -apihost localhost:3000 -apischeme http ...
+//
+// Все пользователи — взаимные друзья, токен пользователя — "token-" + имя.
+// Директы и комментарии от имени собеседников можно писать прямо в консоли:
+//
+//	post bob alice Привет!
+//	comment bob <id поста> Как дела?
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/davidmz/FreefeedDirectBot/fakefrf"
+)
+
+func main() {
+	var (
+		addr  string
+		users string
+	)
+	flag.StringVar(&addr, "addr", "localhost:3000", "address to listen on")
+	flag.StringVar(&users, "users", "alice,bob,carol", "comma-separated user names")
+	flag.Parse()
+
+	srv := fakefrf.New()
+	names := strings.Split(users, ",")
+	for _, name := range names {
+		u := srv.AddUser(name)
+		log.Println("User", u.Name, "token", u.Token)
+	}
+	for i, n1 := range names {
+		for _, n2 := range names[i+1:] {
+			srv.Befriend(n1, n2)
+		}
+	}
+
+	go func() {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			if err := command(srv, scanner.Text()); err != nil {
+				fmt.Println("Error:", err)
+			}
+		}
+	}()
+
+	log.Println("Listening on", addr)
+	log.Fatalln(http.ListenAndServe(addr, srv))
+}
+
+func command(srv *fakefrf.Server, line string) error {
+	f := strings.SplitN(strings.TrimSpace(line), " ", 4)
+	switch {
+	case len(f) == 4 && f[0] == "post":
+		p, err := srv.SendDirect(f[1], f[3], strings.Split(f[2], ",")...)
+		if err == nil {
+			fmt.Println("Post", p.ID)
+		}
+		return err
+	case len(f) == 4 && f[0] == "comment":
+		c, err := srv.AddComment(f[1], f[2], f[3])
+		if err == nil {
+			fmt.Println("Comment", c.ID)
+		}
+		return err
+	case len(f) == 2 && f[0] == "revoke":
+		srv.RevokeToken(f[1])
+		return nil
+	case len(f) == 1 && f[0] == "restart":
+		srv.Restart()
+		return nil
+	case len(f) == 1 && f[0] == "":
+		return nil
+	}
+	return fmt.Errorf("unknown command, use: post <from> <to,...> <text> | comment <from> <post id> <text> | revoke <user> | restart")
+}
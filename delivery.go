@@ -0,0 +1,501 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+var OutboxBucket = []byte("Outbox")
+
+// Лимиты Telegram: не больше ~30 сообщений в секунду всего,
+// около одного в секунду в личный чат и 20 в минуту в группу
+const (
+	globalRate   = 30
+	chatRate     = 1
+	chatBurst    = 3
+	groupRate    = 20.0 / 60
+	groupBurst   = 3
+	maxNetDelay  = 5 * time.Minute
+	maxIdleSleep = time.Hour
+
+	limitSweepInterval = 10 * time.Minute
+)
+
+// Delivery — очередь исходящих сообщений. Сообщения хранятся в базе до успешной
+// отправки, так что неотправленные уведомления переживают перезапуск бота.
+// Порядок сообщений в каждом чате сохраняется.
+type Delivery struct {
+	db        *bolt.DB
+	bot       BotTransport
+	onSent    func(tgbotapi.Chattable, tgbotapi.Message)
+	onBlocked func(chatID int64) // пользователь заблокировал бота
+
+	lk          sync.Mutex
+	chats       map[int64]*chatQueue
+	order       []int64 // чаты с непустыми очередями, по кругу
+	limits      map[int64]*chatLimit
+	lastSweep   time.Time
+	global      *tokenBucket
+	pausedUntil time.Time // после сетевой ошибки ждём все вместе
+	netFailures int
+	wake        chan struct{}
+}
+
+type chatQueue struct {
+	items []*outItem
+}
+
+// chatLimit — лимит отправки в чат. Он живёт дольше очереди: иначе чат, сообщения в который
+// уходят по одному, каждый раз получал бы новый полный лимит. Лимит удаляется, только когда
+// восстановится полностью, то есть ничем не отличается от нового.
+type chatLimit struct {
+	bucket    *tokenBucket
+	notBefore time.Time // Telegram попросил подождать (429)
+}
+
+func (l *chatLimit) idle(now time.Time) bool {
+	l.bucket.refill(now)
+	return l.bucket.tokens >= l.bucket.burst && !now.Before(l.notBefore)
+}
+
+type outItem struct {
+	seq uint64 // ключ в базе, 0 — сообщение не сохраняется
+	msg tgbotapi.Chattable
+}
+
+func NewDelivery(
+	db *bolt.DB,
+	bot BotTransport,
+	onSent func(tgbotapi.Chattable, tgbotapi.Message),
+	onBlocked func(chatID int64),
+) *Delivery {
+	return &Delivery{
+		db:        db,
+		bot:       bot,
+		onSent:    onSent,
+		onBlocked: onBlocked,
+		chats:     make(map[int64]*chatQueue),
+		limits:    make(map[int64]*chatLimit),
+		global:    newTokenBucket(globalRate, globalRate),
+		wake:      make(chan struct{}, 1),
+	}
+}
+
+// Load поднимает из базы сообщения, не отправленные до перезапуска
+func (d *Delivery) Load() {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	count := 0
+	d.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(OutboxBucket).ForEach(func(k, v []byte) error {
+			msg, err := decodeOutgoing(v)
+			if err != nil {
+				log.Println("Can not decode queued message", binary.BigEndian.Uint64(k), err)
+				return nil
+			}
+			d.append(&outItem{seq: binary.BigEndian.Uint64(k), msg: msg})
+			count++
+			return nil
+		})
+	})
+	if count > 0 {
+		log.Println("Loaded", count, "undelivered messages")
+	}
+}
+
+// Push ставит сообщение в очередь (длинное — разбитым на части)
+func (d *Delivery) Push(msg tgbotapi.Chattable) {
+	d.lk.Lock()
+	for _, m := range splitOutgoing(msg) {
+		item := &outItem{msg: m}
+		if data, ok := encodeOutgoing(m); ok {
+			d.db.Update(func(tx *bolt.Tx) error {
+				b := tx.Bucket(OutboxBucket)
+				seq, err := b.NextSequence()
+				if err != nil {
+					return err
+				}
+				item.seq = seq
+				return b.Put(seqKey(seq), data)
+			})
+		}
+		d.append(item)
+	}
+	d.lk.Unlock()
+
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (d *Delivery) append(item *outItem) {
+	chatID := chatOf(item.msg)
+	q := d.chats[chatID]
+	if q == nil {
+		q = new(chatQueue)
+		d.chats[chatID] = q
+	}
+	if len(q.items) == 0 {
+		d.order = append(d.order, chatID)
+	}
+	q.items = append(q.items, item)
+}
+
+// Run отправляет сообщения из очереди, соблюдая лимиты. Не возвращается.
+func (d *Delivery) Run() {
+	for {
+		chatID, item, wait := d.next(time.Now())
+		if item == nil {
+			select {
+			case <-d.wake:
+			case <-time.After(wait):
+			}
+			continue
+		}
+		d.send(chatID, item)
+	}
+}
+
+// next выбирает следующее сообщение, которое можно отправить прямо сейчас.
+// Если таких нет, возвращает время, через которое стоит проверить снова.
+func (d *Delivery) next(now time.Time) (int64, *outItem, time.Duration) {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+
+	wait := maxIdleSleep
+	if now.Before(d.pausedUntil) {
+		return 0, nil, d.pausedUntil.Sub(now)
+	}
+	if w := d.global.wait(now); w > 0 {
+		return 0, nil, w
+	}
+	d.sweepLimits(now)
+	for i, chatID := range d.order {
+		q, limit := d.chats[chatID], d.limitOf(chatID)
+		w := limit.bucket.wait(now)
+		if now.Before(limit.notBefore) && limit.notBefore.Sub(now) > w {
+			w = limit.notBefore.Sub(now)
+		}
+		if w > 0 {
+			if w < wait {
+				wait = w
+			}
+			continue
+		}
+		limit.bucket.take(now)
+		d.global.take(now)
+		// отправленный чат уходит в конец круга, чтобы не задерживать остальных
+		d.order = append(append(d.order[:i:i], d.order[i+1:]...), chatID)
+		return chatID, q.items[0], 0
+	}
+	return 0, nil, wait
+}
+
+func (d *Delivery) send(chatID int64, item *outItem) {
+	sent, err := d.bot.Send(item.msg)
+	if err == nil {
+		d.lk.Lock()
+		d.netFailures = 0
+		d.lk.Unlock()
+		d.done(chatID, item)
+		d.onSent(item.msg, sent)
+		return
+	}
+
+	tgErr, isAPIError := err.(tgbotapi.Error)
+	switch {
+	case isAPIError && tgErr.RetryAfter > 0:
+		log.Println("Telegram asks to wait", tgErr.RetryAfter, "seconds before sending to", chatID)
+		d.lk.Lock()
+		d.limitOf(chatID).notBefore = time.Now().Add(time.Duration(tgErr.RetryAfter) * time.Second)
+		d.lk.Unlock()
+
+	case isBlockedError(err):
+		// остальное в этот чат тоже не уйдёт
+		log.Println("Bot is blocked in chat", chatID)
+		d.dropChat(chatID)
+		d.onBlocked(chatID)
+
+	case isPermanentError(err):
+		log.Println("Can not send message to", chatID, err)
+		d.done(chatID, item)
+
+	default:
+		// сеть или временная ошибка Telegram: повторяем с растущей задержкой
+		d.lk.Lock()
+		d.netFailures++
+		delay := backoff(d.netFailures, maxNetDelay)
+		d.pausedUntil = time.Now().Add(delay)
+		d.lk.Unlock()
+		log.Println("Can not send message, retrying in", delay, err)
+	}
+}
+
+// limitOf возвращает лимит чата chatID. Вызывается под lk.
+func (d *Delivery) limitOf(chatID int64) *chatLimit {
+	l := d.limits[chatID]
+	if l == nil {
+		if chatID < 0 {
+			l = &chatLimit{bucket: newTokenBucket(groupRate, groupBurst)}
+		} else {
+			l = &chatLimit{bucket: newTokenBucket(chatRate, chatBurst)}
+		}
+		d.limits[chatID] = l
+	}
+	return l
+}
+
+// sweepLimits время от времени удаляет восстановившиеся лимиты чатов без очереди. Вызывается под lk.
+func (d *Delivery) sweepLimits(now time.Time) {
+	if now.Sub(d.lastSweep) < limitSweepInterval {
+		return
+	}
+	d.lastSweep = now
+	for chatID, l := range d.limits {
+		if d.chats[chatID] == nil && l.idle(now) {
+			delete(d.limits, chatID)
+		}
+	}
+}
+
+// done убирает сообщение из очереди и из базы
+func (d *Delivery) done(chatID int64, item *outItem) {
+	d.lk.Lock()
+	q := d.chats[chatID]
+	q.items = q.items[1:]
+	if len(q.items) == 0 {
+		delete(d.chats, chatID)
+		for i, id := range d.order {
+			if id == chatID {
+				d.order = append(d.order[:i:i], d.order[i+1:]...)
+				break
+			}
+		}
+	}
+	d.lk.Unlock()
+
+	if item.seq != 0 {
+		d.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(OutboxBucket).Delete(seqKey(item.seq))
+		})
+	}
+}
+
+// dropChat выбрасывает все сообщения в чат chatID
+func (d *Delivery) dropChat(chatID int64) {
+	d.lk.Lock()
+	q := d.chats[chatID]
+	delete(d.chats, chatID)
+	for i, id := range d.order {
+		if id == chatID {
+			d.order = append(d.order[:i:i], d.order[i+1:]...)
+			break
+		}
+	}
+	d.lk.Unlock()
+
+	if q == nil {
+		return
+	}
+	d.db.Update(func(tx *bolt.Tx) error {
+		for _, item := range q.items {
+			if item.seq != 0 {
+				tx.Bucket(OutboxBucket).Delete(seqKey(item.seq))
+			}
+		}
+		return nil
+	})
+}
+
+func isBlockedError(err error) bool {
+	return strings.HasPrefix(err.Error(), "Forbidden: bot was blocked by the user") ||
+		strings.HasPrefix(err.Error(), "Forbidden: user is deactivated")
+}
+
+// Ошибки запроса (400) и запрета доступа (403) при повторе не исчезнут
+// (при загрузке файлов библиотека возвращает их не как tgbotapi.Error, а как простые ошибки)
+func isPermanentError(err error) bool {
+	return strings.HasPrefix(err.Error(), "Bad Request") || strings.HasPrefix(err.Error(), "Forbidden")
+}
+
+// backoff — экспоненциальная задержка со случайным разбросом
+func backoff(attempt int, max time.Duration) time.Duration {
+	delay := max
+	if attempt < 20 {
+		if d := time.Second << uint(attempt-1); d < max {
+			delay = d
+		}
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+func seqKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
+
+type tokenBucket struct {
+	rate   float64 // в секунду
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+}
+
+// wait возвращает, сколько осталось ждать до появления свободного токена
+func (b *tokenBucket) wait(now time.Time) time.Duration {
+	b.refill(now)
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+func (b *tokenBucket) take(now time.Time) {
+	b.refill(now)
+	b.tokens--
+}
+
+// Сохраняемое в базе сообщение. Сохраняются только те виды сообщений, которые отправляет бот;
+// прочие (например, загрузка файлов) живут только в памяти.
+type storedMessage struct {
+	Kind string
+	Msg  json.RawMessage
+	// у notice эти поля не сериализуются, храним отдельно
+	NoticePostID    string `json:",omitempty"`
+	NoticeCommentID string `json:",omitempty"`
+}
+
+const (
+	kindMessage    = "message"
+	kindPost       = "post"
+	kindPhoto      = "photo"
+	kindDocument   = "document"
+	kindMediaGroup = "media group"
+	kindEditText   = "edit text"
+	kindEditMarkup = "edit markup"
+)
+
+func encodeOutgoing(msg tgbotapi.Chattable) ([]byte, bool) {
+	sm := &storedMessage{}
+	switch m := msg.(type) {
+	case tgbotapi.MessageConfig:
+		sm.Kind = kindMessage
+	case postMessage:
+		sm.Kind = kindPost
+		if m.Notice != nil {
+			sm.NoticePostID, sm.NoticeCommentID = m.Notice.PostID, m.Notice.CommentID
+		}
+	case tgbotapi.PhotoConfig:
+		if !m.UseExisting {
+			return nil, false
+		}
+		sm.Kind = kindPhoto
+	case tgbotapi.DocumentConfig:
+		if !m.UseExisting {
+			return nil, false
+		}
+		sm.Kind = kindDocument
+	case tgbotapi.MediaGroupConfig:
+		sm.Kind = kindMediaGroup
+	case tgbotapi.EditMessageTextConfig:
+		sm.Kind = kindEditText
+	case tgbotapi.EditMessageReplyMarkupConfig:
+		sm.Kind = kindEditMarkup
+	default:
+		return nil, false
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil, false
+	}
+	sm.Msg = data
+	data, err = json.Marshal(sm)
+	return data, err == nil
+}
+
+func decodeOutgoing(data []byte) (tgbotapi.Chattable, error) {
+	sm := &storedMessage{}
+	if err := json.Unmarshal(data, sm); err != nil {
+		return nil, err
+	}
+	var err error
+	switch sm.Kind {
+	case kindMessage:
+		m := tgbotapi.MessageConfig{}
+		err = json.Unmarshal(sm.Msg, &m)
+		return m, err
+	case kindPost:
+		m := postMessage{}
+		err = json.Unmarshal(sm.Msg, &m)
+		if m.Notice != nil {
+			m.Notice.PostID, m.Notice.CommentID = sm.NoticePostID, sm.NoticeCommentID
+		}
+		return m, err
+	case kindPhoto:
+		m := tgbotapi.PhotoConfig{}
+		err = json.Unmarshal(sm.Msg, &m)
+		return m, err
+	case kindDocument:
+		m := tgbotapi.DocumentConfig{}
+		err = json.Unmarshal(sm.Msg, &m)
+		return m, err
+	case kindMediaGroup:
+		m := tgbotapi.MediaGroupConfig{}
+		err = json.Unmarshal(sm.Msg, &m)
+		return m, err
+	case kindEditText:
+		m := tgbotapi.EditMessageTextConfig{}
+		err = json.Unmarshal(sm.Msg, &m)
+		return m, err
+	case kindEditMarkup:
+		m := tgbotapi.EditMessageReplyMarkupConfig{}
+		err = json.Unmarshal(sm.Msg, &m)
+		return m, err
+	}
+	return nil, fmt.Errorf("unknown message kind %q", sm.Kind)
+}
+
+func chatOf(msg tgbotapi.Chattable) int64 {
+	switch m := msg.(type) {
+	case tgbotapi.MessageConfig:
+		return m.ChatID
+	case postMessage:
+		return m.ChatID
+	case tgbotapi.PhotoConfig:
+		return m.ChatID
+	case tgbotapi.DocumentConfig:
+		return m.ChatID
+	case tgbotapi.MediaGroupConfig:
+		return m.ChatID
+	case tgbotapi.EditMessageTextConfig:
+		return m.ChatID
+	case tgbotapi.EditMessageReplyMarkupConfig:
+		return m.ChatID
+	}
+	return 0
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/davidmz/FreefeedDirectBot/faketg"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// сообщения, уходящие в чат по одному, не должны каждый раз получать новый лимит
+func TestChatLimitOutlivesQueue(t *testing.T) {
+	d := NewDelivery(nil, nil, nil, nil)
+	now := time.Now()
+
+	for i := 0; i < chatBurst; i++ {
+		d.append(&outItem{msg: tgbotapi.NewMessage(1, "test")})
+		chatID, item, _ := d.next(now)
+		if item == nil {
+			t.Fatalf("message %d is not sent within burst", i+1)
+		}
+		d.done(chatID, item)
+	}
+
+	d.append(&outItem{msg: tgbotapi.NewMessage(1, "test")})
+	if _, item, wait := d.next(now); item != nil || wait <= 0 {
+		t.Fatalf("message beyond burst is sent without waiting")
+	}
+	if _, item, _ := d.next(now.Add(time.Second / chatRate)); item == nil {
+		t.Fatalf("message is not sent after the limit is restored")
+	}
+}
+
+func TestIdleChatLimitsAreSwept(t *testing.T) {
+	d := NewDelivery(nil, nil, nil, nil)
+	now := time.Now()
+
+	d.append(&outItem{msg: tgbotapi.NewMessage(1, "test")})
+	chatID, item, _ := d.next(now)
+	d.done(chatID, item)
+
+	d.next(now.Add(limitSweepInterval))
+	if len(d.limits) != 0 {
+		t.Fatalf("restored limit of an empty chat is kept")
+	}
+}
+
+// newTestDelivery — очередь с базой и поддельным Telegram; заблокировавшие бота чаты попадают в blocked
+func newTestDelivery(t *testing.T) (d *Delivery, bot *faketg.Bot, blocked *[]int64) {
+	bot = faketg.New()
+	blocked = new([]int64)
+	d = NewDelivery(testDB(t), bot, func(tgbotapi.Chattable, tgbotapi.Message) {}, func(chatID int64) {
+		*blocked = append(*blocked, chatID)
+	})
+	return
+}
+
+// sendNext отправляет следующее сообщение из очереди, если его можно отправить в момент now
+func (d *Delivery) sendNext(t *testing.T, now time.Time) {
+	t.Helper()
+	chatID, item, _ := d.next(now)
+	if item == nil {
+		t.Fatal("no message to send")
+	}
+	d.send(chatID, item)
+}
+
+func (d *Delivery) queued(chatID int64) int {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	if q := d.chats[chatID]; q != nil {
+		return len(q.items)
+	}
+	return 0
+}
+
+func (d *Delivery) stored() (n int) {
+	d.db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(OutboxBucket).Stats().KeyN
+		return nil
+	})
+	return
+}
+
+func TestDeliveryRetryAfter(t *testing.T) {
+	d, bot, _ := newTestDelivery(t)
+	d.Push(tgbotapi.NewMessage(1, "test"))
+	bot.FailNext(faketg.TooManyRequests(30))
+	now := time.Now()
+	d.sendNext(t, now)
+
+	if d.queued(1) != 1 || d.stored() != 1 {
+		t.Fatal("message is not kept after 429")
+	}
+	if nb := d.limitOf(1).notBefore; nb.Before(now.Add(29*time.Second)) || nb.After(time.Now().Add(30*time.Second)) {
+		t.Fatalf("chat is paused until %v, want in 30s", nb)
+	}
+	if _, item, wait := d.next(time.Now()); item != nil || wait < 29*time.Second {
+		t.Fatalf("message is sent before retry_after, wait %v", wait)
+	}
+	// другие чаты не ждут
+	d.Push(tgbotapi.NewMessage(2, "test"))
+	if chatID, item, _ := d.next(time.Now()); item == nil || chatID != 2 {
+		t.Fatal("other chat waits for retry_after")
+	}
+	d.sendNext(t, now.Add(31*time.Second))
+	if d.queued(1) != 0 || len(bot.Sent()) != 1 {
+		t.Fatal("message is not sent after retry_after")
+	}
+}
+
+func TestDeliveryNetworkBackoff(t *testing.T) {
+	d, bot, _ := newTestDelivery(t)
+	d.Push(tgbotapi.NewMessage(1, "test"))
+	bot.FailNext(errors.New("connection reset"), errors.New("connection reset"))
+
+	d.sendNext(t, time.Now())
+	first := d.pausedUntil
+	if d.netFailures != 1 || first.Before(time.Now()) {
+		t.Fatalf("delivery is not paused after a network error: %d failures, until %v", d.netFailures, first)
+	}
+	if _, item, wait := d.next(time.Now()); item != nil || wait <= 0 {
+		t.Fatal("message is sent during the pause")
+	}
+
+	d.sendNext(t, first)
+	if d.netFailures != 2 || d.queued(1) != 1 {
+		t.Fatalf("second failure is not counted: %d", d.netFailures)
+	}
+	d.sendNext(t, d.pausedUntil)
+	if d.netFailures != 0 || d.queued(1) != 0 || d.stored() != 0 {
+		t.Fatal("message is not sent after the pause")
+	}
+}
+
+func TestDeliveryPermanentError(t *testing.T) {
+	d, bot, blocked := newTestDelivery(t)
+	d.Push(tgbotapi.NewMessage(1, "bad"))
+	d.Push(tgbotapi.NewMessage(1, "good"))
+	bot.FailNext(tgbotapi.Error{Message: "Bad Request: message text is empty"})
+
+	now := time.Now()
+	d.sendNext(t, now)
+	d.sendNext(t, now)
+	if sent := bot.Sent(); len(sent) != 1 || sent[0].Text != "good" || d.stored() != 0 {
+		t.Fatalf("bad message is not dropped: %+v", sent)
+	}
+	if len(*blocked) != 0 {
+		t.Fatal("chat is reported as blocked")
+	}
+}
+
+func TestDeliveryBlocked(t *testing.T) {
+	d, bot, blocked := newTestDelivery(t)
+	bot.Block(1)
+	for i := 0; i < 3; i++ {
+		d.Push(tgbotapi.NewMessage(1, "test"))
+	}
+	d.Push(tgbotapi.NewMessage(2, "test"))
+
+	now := time.Now()
+	d.sendNext(t, now)
+	if len(*blocked) != 1 || (*blocked)[0] != 1 {
+		t.Fatalf("onBlocked is called for %v", *blocked)
+	}
+	if d.queued(1) != 0 || d.stored() != 1 {
+		t.Fatal("messages to the blocked chat are kept")
+	}
+	d.sendNext(t, now)
+	if sent := bot.Sent(); len(sent) != 1 || sent[0].ChatID != 2 {
+		t.Fatalf("message to the other chat is not sent: %+v", sent)
+	}
+}
+
+// неотправленные сообщения, в том числе уведомления, переживают перезапуск
+func TestDeliveryLoad(t *testing.T) {
+	d, _, _ := newTestDelivery(t)
+	n := &notice{PostID: "post1", CommentID: "comment1", Header: "💬 bob", Author: "bob", Account: "alice", Host: "example.com"}
+	pm := postMessage{MessageConfig: tgbotapi.NewMessage(1, "notice"), PostID: "post1", Account: "alice", Host: "example.com", Notice: n}
+	d.Push(pm)
+	d.Push(tgbotapi.NewEditMessageText(1, 10, "edited"))
+	d.Push(tgbotapi.NewPhotoUpload(1, "photo.png")) // загрузки файлов не сохраняются
+
+	// перезапуск: база открывается заново из файла
+	path := d.db.Path()
+	d.db.Close()
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	loaded := NewDelivery(db, nil, nil, nil)
+	loaded.Load()
+	q := loaded.chats[1]
+	if q == nil || len(q.items) != 2 {
+		t.Fatalf("loaded %+v, want 2 messages", q)
+	}
+	got, ok := q.items[0].msg.(postMessage)
+	if !ok || got.Text != "notice" || got.PostID != "post1" || got.Account != "alice" || got.Host != "example.com" {
+		t.Fatalf("post message is not restored: %+v", q.items[0].msg)
+	}
+	if got.Notice == nil || *got.Notice != *n {
+		t.Errorf("notice is not restored: %+v", got.Notice)
+	}
+	if e, ok := q.items[1].msg.(tgbotapi.EditMessageTextConfig); !ok || e.MessageID != 10 || e.Text != "edited" {
+		t.Errorf("edit is not restored: %+v", q.items[1].msg)
+	}
+	if q.items[0].seq == 0 || q.items[0].seq >= q.items[1].seq {
+		t.Error("messages are loaded out of order")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	const max = 5 * time.Minute
+	for _, c := range []struct {
+		attempt int
+		base    time.Duration // задержка без разброса
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{5, 16 * time.Second},
+		{9, 256 * time.Second},
+		{10, max},
+		{19, max},
+		{20, max},
+		{1000, max},
+	} {
+		var low, high bool
+		for i := 0; i < 200; i++ {
+			d := backoff(c.attempt, max)
+			if d < c.base/2 || d > c.base {
+				t.Fatalf("backoff(%d) = %v, want in [%v, %v]", c.attempt, d, c.base/2, c.base)
+			}
+			low = low || d < c.base*3/4
+			high = high || d >= c.base*3/4
+		}
+		if !low || !high {
+			t.Errorf("backoff(%d) is not jittered over [%v, %v]", c.attempt, c.base/2, c.base)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/davidmz/FreefeedDirectBot/faketg"
+)
+
+// Сквозные сценарии: бот целиком, с realtime-соединениями, против fakefrf
+
+// waitRT ждёт, пока сервер подтвердит realtime-подписку аккаунта name пользователя userID
+func (e *testEnv) waitRT(userID int64, name string) {
+	e.t.Helper()
+	key := rtKey{UserID: userID, Host: e.app.apiHost, Account: name}
+	e.waitFor("realtime subscription of "+name, func() bool {
+		h, ok := e.app.RTHealth(userID)[key]
+		return ok && h.Subscription == SubConfirmed
+	})
+}
+
+// countingTransport считает запросы, прошедшие через App.httpClient
+type countingTransport struct {
+	lk    sync.Mutex
+	paths []string
+}
+
+func (c *countingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	c.lk.Lock()
+	c.paths = append(c.paths, r.URL.Path)
+	c.lk.Unlock()
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func (c *countingTransport) has(path string) bool {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	for _, p := range c.paths {
+		if p == path {
+			return true
+		}
+	}
+	return false
+}
+
+func TestE2ENotifications(t *testing.T) {
+	e := newTestEnv(t)
+	e.friends("alice", "bob")
+	e.login(alice, "alice")
+	e.waitRT(alice, "alice")
+
+	post, err := e.frf.SendDirect("bob", "Ты тут?", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.run(faketg.Expect(alice, "📨 bob написал вам:\n"+separator+"\nТы тут?\n"+separator+"\n№ "+shortCode(post.ID)))
+
+	if _, err := e.frf.AddComment("bob", post.ID, "Ау!"); err != nil {
+		t.Fatal(err)
+	}
+	e.run(faketg.Expect(alice, "💬 bob ответил на пост «Ты тут?»:\n"+separator+"\nАу!*"))
+
+	// ответ на уведомление — комментарий от имени alice
+	e.replyToLast(alice, "Тут")
+	e.run(faketg.Expect(alice, "Комментарий отправлен!"))
+	if cc := e.frf.Comments(post.ID); len(cc) != 2 || cc[1].Body != "Тут" {
+		t.Fatalf("unexpected comments %+v", cc)
+	}
+}
+
+func TestE2EDirectAndComment(t *testing.T) {
+	e := newTestEnv(t)
+	e.friends("alice", "bob")
+	e.login(alice, "alice")
+	e.login(bob, "bob")
+	e.waitRT(alice, "alice")
+	e.waitRT(bob, "bob")
+
+	e.run(
+		faketg.Say(alice, "/to_bob"),
+		faketg.Expect(alice, "OK, ваше сообщение для bob (/cancel — отмена):"),
+		e.action(alice, ActComposePost),
+		faketg.Say(alice, "Привет, Боб!"),
+		faketg.Expect(alice, "Сообщение отправлено!"),
+		faketg.Expect(bob, "📨 alice написал вам:\n"+separator+"\nПривет, Боб!*"),
+	)
+	post := e.postByBody("Привет, Боб!")
+
+	e.run(
+		faketg.Say(bob, "/re_"+shortCode(post.ID)),
+		faketg.Expect(bob, "OK, ваш комментарий к сообщению alice «Привет, Боб!» (/cancel — отмена):"),
+		e.action(bob, ActAddComment),
+		faketg.Say(bob, "Привет!"),
+		faketg.Expect(bob, "Комментарий отправлен!"),
+		faketg.Expect(alice, "💬 bob ответил на пост «Привет, Боб!»:\n"+separator+"\nПривет!*"),
+	)
+}
+
+func TestE2EPhoto(t *testing.T) {
+	e := newTestEnv(t)
+	files := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"))
+	}))
+	defer files.Close()
+	e.bot.Files["photo-1"] = files.URL + "/photo.png"
+	transport := &countingTransport{}
+	e.app.httpClient = &http.Client{Transport: transport}
+
+	e.friends("alice", "bob")
+	e.login(alice, "alice")
+	e.run(
+		faketg.Say(alice, "/to_bob"),
+		faketg.Expect(alice, "OK, ваше сообщение для bob*"),
+		e.action(alice, ActComposePost),
+	)
+	e.bot.SendPhoto(alice, "photo-1", "Смотри")
+	e.run(faketg.Expect(alice, "Сообщение отправлено!"))
+
+	if p := e.postByBody("Смотри"); len(p.AttachmentIDs) != 1 {
+		t.Errorf("post has %d attachments, want 1", len(p.AttachmentIDs))
+	}
+	if !transport.has("/photo.png") {
+		t.Error("file is not downloaded with the app HTTP client")
+	}
+}
+
+func TestE2ETokenRevoked(t *testing.T) {
+	e := newTestEnv(t)
+	e.friends("alice", "bob")
+	e.login(alice, "alice")
+	e.waitRT(alice, "alice")
+
+	post, err := e.frf.SendDirect("bob", "Ты тут?", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.run(faketg.Expect(alice, "📨 bob написал вам:*"))
+
+	// отозванный токен обнаруживается при первом же запросе к API
+	e.frf.RevokeToken("alice")
+	e.run(
+		faketg.Say(alice, "/re_"+post.ID),
+		faketg.Expect(alice, ReauthMessage("alice", e.app.apiHost)),
+		faketg.Expect(alice, "Что-то пошло не так*"),
+		e.action(alice, ActNewToken),
+	)
+
+	e.frf.SetToken("alice", "token-alice-2")
+	e.run(
+		faketg.Say(alice, "token-alice-2"),
+		faketg.Expect(alice, "Спасибо, проверяю ваш токен…"),
+		faketg.Expect(alice, "Аккаунт alice подключён и сейчас активен.*"),
+	)
+	e.waitRT(alice, "alice")
+
+	// с новым токеном уведомления приходят снова
+	if _, err := e.frf.SendDirect("bob", "С возвращением", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	e.run(faketg.Expect(alice, "📨 bob написал вам:\n"+separator+"\nС возвращением*"))
+}
+
+func TestE2ELongNoticeEdit(t *testing.T) {
+	e := newTestEnv(t)
+	e.friends("alice", "bob")
+	e.login(alice, "alice")
+	e.waitRT(alice, "alice")
+
+	long := strings.Repeat("Очень длинное письмо. ", maxMessageLen/15)
+	post, err := e.frf.SendDirect("bob", long, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.run(
+		faketg.Expect(alice, "📨 bob написал вам:*"),
+		faketg.Expect(alice, "*"),
+	)
+	e.waitFor("both parts are remembered", func() bool {
+		return len(e.app.findNotices(alice, post.ID, "", false)) == 2
+	})
+	parts := e.bot.Sent()
+	first, last := parts[len(parts)-2], parts[len(parts)-1]
+	if !strings.HasSuffix(last.Text, "(2/2)") || last.Markup == nil {
+		t.Fatalf("unexpected last part %+v", last)
+	}
+
+	e.app.UpdateNotices(alice, post.ID, "", long+"И ещё.")
+	sent, err := e.bot.WaitSent(len(parts)+2, stepTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edits := map[int]*faketg.Sent{}
+	for _, s := range sent[len(parts):] {
+		if s.Kind == "edit text" {
+			edits[s.MessageID] = s
+		}
+	}
+	if edit := edits[first.MessageID]; edit == nil || edit.Text != "✏️ изменено, новый текст — в последней части уведомления" {
+		t.Errorf("first part is not edited: %+v", edit)
+	}
+	edit := edits[last.MessageID]
+	if edit == nil || edit.Markup == nil {
+		t.Fatalf("last part is not edited with a keyboard: %+v", edit)
+	}
+	if !strings.HasSuffix(edit.Text, shortenedMark+"\n✏️ изменено") || utf16Len([]rune(edit.Text)) > maxMessageLen {
+		t.Errorf("edited text is not marked as shortened or too long: %q", edit.Text)
+	}
+}
@@ -0,0 +1,51 @@
+package fakefrf
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/davidmz/FreefeedDirectBot/socketio"
+)
+
+func (s *Server) authorizeRT(r *http.Request) int {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	if s.userByToken(r.URL.Query().Get("token")) == nil {
+		return http.StatusUnauthorized
+	}
+	return 0
+}
+
+// onRTEvent обрабатывает подписку на ленты. Подписаться можно только на свою ленту директов.
+func (s *Server) onRTEvent(c *socketio.ServerConn, event string, args []json.RawMessage) []interface{} {
+	if event != "subscribe" || len(args) == 0 {
+		return []interface{}{map[string]interface{}{"success": false, "message": "Unknown event"}}
+	}
+	req := &struct {
+		Timeline []string `json:"timeline"`
+	}{}
+	json.Unmarshal(args[0], req)
+
+	s.lk.Lock()
+	user := s.userByToken(c.Request.URL.Query().Get("token"))
+	s.lk.Unlock()
+	if user == nil {
+		return []interface{}{map[string]interface{}{"success": false, "message": "Unauthorized"}}
+	}
+	for _, id := range req.Timeline {
+		if id != user.DirectsFeedID {
+			return []interface{}{map[string]interface{}{"success": false, "message": "Access denied"}}
+		}
+	}
+	for _, id := range req.Timeline {
+		c.Join("timeline:" + id)
+	}
+	return []interface{}{map[string]interface{}{"success": true}}
+}
+
+// emit рассылает событие о посте всем подписанным на ленты директов его участников
+func (s *Server) emit(post *Post, event string, data interface{}) {
+	for _, feedID := range post.FeedIDs {
+		s.rt.EmitTo("timeline:"+feedID, event, data)
+	}
+}
@@ -0,0 +1,696 @@
+// Package fakefrf — упрощённый сервер FreeFeed в памяти: REST API директов и realtime.
+// Умеет ровно то, чем пользуется бот, и позволяет гонять его локально, без freefeed.net.
+package fakefrf
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davidmz/FreefeedDirectBot/socketio"
+)
+
+const pageSize = 30
+
+var (
+	ErrUnknownUser = errors.New("Unknown user")
+	ErrNotFriends  = errors.New("You can not send private messages to this user")
+)
+
+type User struct {
+	ID            string
+	Name          string
+	Token         string
+	DirectsFeedID string
+	PostsFeedID   string
+}
+
+type Post struct {
+	ID            string
+	AuthorID      string
+	Body          string
+	FeedIDs       []string // директ-ленты участников
+	AttachmentIDs []string
+	CommentIDs    []string
+	Likes         []string // ID лайкнувших
+	CreatedAt     int64
+	BumpedAt      int64
+}
+
+type Comment struct {
+	ID        string
+	PostID    string
+	AuthorID  string
+	Body      string
+	CreatedAt int64
+}
+
+type Attachment struct {
+	ID        string
+	FileName  string
+	MediaType string
+	Size      int
+}
+
+type Server struct {
+	lk          sync.Mutex
+	users       map[string]*User // по ID
+	friends     map[string]map[string]bool
+	posts       map[string]*Post
+	comments    map[string]*Comment
+	attachments map[string]*Attachment
+	lastID      int
+	lastTime    int64
+
+	rt   *socketio.Server
+	http *httptest.Server
+}
+
+// New создаёт сервер. Чтобы он начал принимать запросы, нужен Start (или ServeHTTP в своём http.Server).
+func New() *Server {
+	s := &Server{
+		users:       make(map[string]*User),
+		friends:     make(map[string]map[string]bool),
+		posts:       make(map[string]*Post),
+		comments:    make(map[string]*Comment),
+		attachments: make(map[string]*Attachment),
+	}
+	s.rt = &socketio.Server{
+		PingInterval: 25 * time.Second,
+		PingTimeout:  60 * time.Second,
+		Authorize:    s.authorizeRT,
+		OnEvent:      s.onRTEvent,
+	}
+	return s
+}
+
+// Start запускает сервер на случайном локальном порту (без TLS)
+func (s *Server) Start() {
+	s.http = httptest.NewServer(s)
+}
+
+// Host возвращает адрес запущенного сервера в виде host:port
+func (s *Server) Host() string { return strings.TrimPrefix(s.http.URL, "http://") }
+
+func (s *Server) Close() {
+	s.rt.CloseAll()
+	if s.http != nil {
+		s.http.Close()
+	}
+}
+
+func (s *Server) newID() string {
+	s.lastID++
+	return strconv.Itoa(s.lastID)
+}
+
+// now возвращает строго возрастающее время в миллисекундах
+func (s *Server) now() int64 {
+	t := time.Now().UnixNano() / int64(time.Millisecond)
+	if t <= s.lastTime {
+		t = s.lastTime + 1
+	}
+	s.lastTime = t
+	return t
+}
+
+// AddUser заводит пользователя; его токен — "token-" + name
+func (s *Server) AddUser(name string) *User {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	u := &User{
+		ID:            s.newID(),
+		Name:          name,
+		Token:         "token-" + name,
+		DirectsFeedID: s.newID(),
+		PostsFeedID:   s.newID(),
+	}
+	s.users[u.ID] = u
+	s.friends[u.ID] = make(map[string]bool)
+	return u
+}
+
+// Befriend делает пользователей взаимными друзьями, чтобы они могли писать друг другу директы
+func (s *Server) Befriend(name1, name2 string) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	u1, u2 := s.userByName(name1), s.userByName(name2)
+	s.friends[u1.ID][u2.ID] = true
+	s.friends[u2.ID][u1.ID] = true
+}
+
+// RevokeToken отзывает токен пользователя и рвёт его realtime-соединения
+func (s *Server) RevokeToken(name string) {
+	s.lk.Lock()
+	u := s.userByName(name)
+	if u == nil {
+		s.lk.Unlock()
+		return
+	}
+	token := u.Token
+	u.Token = ""
+	s.lk.Unlock()
+
+	for _, c := range s.rt.Conns() {
+		if c.Request.URL.Query().Get("token") == token {
+			c.Close()
+		}
+	}
+}
+
+// SetToken выдаёт пользователю новый токен
+func (s *Server) SetToken(name, token string) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	s.userByName(name).Token = token
+}
+
+// Restart рвёт все realtime-соединения, как при перезапуске сервера
+func (s *Server) Restart() { s.rt.CloseAll() }
+
+// Posts возвращает все посты, от новых к старым по последней активности
+func (s *Server) Posts() []*Post {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	var posts []*Post
+	for _, p := range s.posts {
+		cp := *p
+		posts = append(posts, &cp)
+	}
+	sort.Slice(posts, func(i, j int) bool { return posts[i].BumpedAt > posts[j].BumpedAt })
+	return posts
+}
+
+func (s *Server) Comments(postID string) []*Comment {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	var comments []*Comment
+	if p := s.posts[postID]; p != nil {
+		for _, id := range p.CommentIDs {
+			cp := *s.comments[id]
+			comments = append(comments, &cp)
+		}
+	}
+	return comments
+}
+
+// SendDirect пишет директ от имени author — так «собеседник» бота создаёт события
+func (s *Server) SendDirect(author string, body string, to ...string) (*Post, error) {
+	s.lk.Lock()
+	u := s.userByName(author)
+	s.lk.Unlock()
+	if u == nil {
+		return nil, ErrUnknownUser
+	}
+	return s.createPost(u, body, to, nil)
+}
+
+// AddComment комментирует пост от имени author
+func (s *Server) AddComment(author string, postID string, body string) (*Comment, error) {
+	s.lk.Lock()
+	u := s.userByName(author)
+	s.lk.Unlock()
+	if u == nil {
+		return nil, ErrUnknownUser
+	}
+	return s.createComment(u, postID, body)
+}
+
+func (s *Server) userByName(name string) *User {
+	for _, u := range s.users {
+		if u.Name == name {
+			return u
+		}
+	}
+	return nil
+}
+
+func (s *Server) userByToken(token string) *User {
+	if token == "" {
+		return nil
+	}
+	for _, u := range s.users {
+		if u.Token == token {
+			return u
+		}
+	}
+	return nil
+}
+
+func (s *Server) createPost(author *User, body string, to []string, attachmentIDs []string) (*Post, error) {
+	s.lk.Lock()
+	post := &Post{
+		ID:            s.newID(),
+		AuthorID:      author.ID,
+		Body:          body,
+		FeedIDs:       []string{author.DirectsFeedID},
+		AttachmentIDs: attachmentIDs,
+	}
+	for _, name := range to {
+		u := s.userByName(name)
+		if u == nil {
+			s.lk.Unlock()
+			return nil, ErrUnknownUser
+		}
+		if !s.friends[author.ID][u.ID] {
+			s.lk.Unlock()
+			return nil, ErrNotFriends
+		}
+		post.FeedIDs = append(post.FeedIDs, u.DirectsFeedID)
+	}
+	post.CreatedAt = s.now()
+	post.BumpedAt = post.CreatedAt
+	s.posts[post.ID] = post
+	event := s.postJSON(post, false)
+	s.lk.Unlock()
+
+	s.emit(post, "post:new", event)
+	return post, nil
+}
+
+func (s *Server) createComment(author *User, postID string, body string) (*Comment, error) {
+	s.lk.Lock()
+	post := s.posts[postID]
+	if post == nil || !s.canRead(author, post) {
+		s.lk.Unlock()
+		return nil, errNotFound
+	}
+	comment := &Comment{ID: s.newID(), PostID: postID, AuthorID: author.ID, Body: body, CreatedAt: s.now()}
+	s.comments[comment.ID] = comment
+	post.CommentIDs = append(post.CommentIDs, comment.ID)
+	post.BumpedAt = comment.CreatedAt
+	event := s.commentJSON(comment)
+	s.lk.Unlock()
+
+	s.emit(post, "comment:new", event)
+	return comment, nil
+}
+
+func (s *Server) canRead(u *User, p *Post) bool {
+	for _, f := range p.FeedIDs {
+		if f == u.DirectsFeedID {
+			return true
+		}
+	}
+	return false
+}
+
+/////////////////////
+// REST API
+
+var (
+	errNotFound     = errors.New("Not found")
+	errUnauthorized = errors.New("Unauthorized")
+	errForbidden    = errors.New("Forbidden")
+)
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/socket.io/") {
+		s.rt.ServeHTTP(w, r)
+		return
+	}
+
+	s.lk.Lock()
+	user := s.userByToken(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	s.lk.Unlock()
+	if user == nil {
+		writeError(w, http.StatusUnauthorized, errUnauthorized)
+		return
+	}
+
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	route := r.Method + " " + strings.Join(path[:min(len(path), 3)], "/")
+	var (
+		resp interface{}
+		err  error
+	)
+	switch {
+	case route == "GET v2/timelines/filter" && len(path) == 4 && path[3] == "directs":
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		resp = s.directs(user, offset)
+	case route == "GET v2/users/whoami":
+		resp = s.whoami(user)
+	case route == "GET v2/users/markAllDirectsAsRead":
+		resp = map[string]interface{}{}
+	case strings.HasPrefix(route, "GET v2/posts/") && len(path) == 3:
+		resp, err = s.getPost(user, path[2])
+	case route == "POST v1/posts":
+		resp, err = s.handleNewPost(user, r.Body)
+	case route == "POST v1/comments":
+		resp, err = s.handleNewComment(user, r.Body)
+	case route == "POST v1/attachments":
+		resp, err = s.handleAttachment(r)
+	case strings.HasPrefix(route, "POST v1/posts/") && len(path) == 4 && (path[3] == "like" || path[3] == "unlike"):
+		resp, err = s.handleLike(user, path[2], path[3] == "like")
+	case strings.HasPrefix(route, "PUT v1/posts/") && len(path) == 3:
+		resp, err = s.handleUpdate(user, "post", path[2], r.Body)
+	case strings.HasPrefix(route, "PUT v1/comments/") && len(path) == 3:
+		resp, err = s.handleUpdate(user, "comment", path[2], r.Body)
+	case strings.HasPrefix(route, "DELETE v1/posts/") && len(path) == 3:
+		resp, err = s.handleDelete(user, "post", path[2])
+	case strings.HasPrefix(route, "DELETE v1/comments/") && len(path) == 3:
+		resp, err = s.handleDelete(user, "comment", path[2])
+	default:
+		err = errNotFound
+	}
+
+	switch err {
+	case nil:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	case errNotFound:
+		writeError(w, http.StatusNotFound, err)
+	case errForbidden, ErrNotFriends:
+		writeError(w, http.StatusForbidden, err)
+	default:
+		writeError(w, http.StatusBadRequest, err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"err": err.Error()})
+}
+
+func (s *Server) directs(user *User, offset int) interface{} {
+	var posts []*Post
+	for _, p := range s.Posts() {
+		if s.canRead(user, p) {
+			posts = append(posts, p)
+		}
+	}
+	if offset > len(posts) {
+		offset = len(posts)
+	}
+	end := min(offset+pageSize, len(posts))
+
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	resp := s.staff()
+	jposts := []interface{}{}
+	for _, p := range posts[offset:end] {
+		jposts = append(jposts, s.postObject(p))
+	}
+	resp["timelines"] = map[string]string{"id": user.DirectsFeedID, "user": user.ID}
+	resp["posts"] = jposts
+	resp["isLastPage"] = end == len(posts)
+	return resp
+}
+
+func (s *Server) whoami(user *User) interface{} {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	subscribers := []map[string]string{}
+	subscriptions := []map[string]string{}
+	for id := range s.friends[user.ID] {
+		f := s.users[id]
+		subscribers = append(subscribers, map[string]string{"id": f.ID, "username": f.Name})
+		subscriptions = append(subscriptions, map[string]string{"id": f.PostsFeedID, "name": "Posts", "user": f.ID})
+	}
+	return map[string]interface{}{
+		"users":         map[string]interface{}{"id": user.ID, "username": user.Name, "subscribers": subscribers},
+		"subscriptions": subscriptions,
+	}
+}
+
+func (s *Server) getPost(user *User, postID string) (interface{}, error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	post := s.posts[postID]
+	if post == nil || !s.canRead(user, post) {
+		return nil, errNotFound
+	}
+	return s.postJSON(post, true), nil
+}
+
+func (s *Server) handleNewPost(user *User, body io.Reader) (interface{}, error) {
+	req := &struct {
+		Meta struct {
+			Feeds []string `json:"feeds"`
+		} `json:"meta"`
+		Post struct {
+			Body        string   `json:"body"`
+			Attachments []string `json:"attachments"`
+		} `json:"post"`
+	}{}
+	if err := json.NewDecoder(body).Decode(req); err != nil {
+		return nil, err
+	}
+	post, err := s.createPost(user, req.Post.Body, req.Meta.Feeds, req.Post.Attachments)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"posts": map[string]string{"id": post.ID}}, nil
+}
+
+func (s *Server) handleNewComment(user *User, body io.Reader) (interface{}, error) {
+	req := &struct {
+		Comment struct {
+			Body   string `json:"body"`
+			PostID string `json:"postId"`
+		} `json:"comment"`
+	}{}
+	if err := json.NewDecoder(body).Decode(req); err != nil {
+		return nil, err
+	}
+	comment, err := s.createComment(user, req.Comment.PostID, req.Comment.Body)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"comments": map[string]string{"id": comment.ID, "postId": comment.PostID}}, nil
+}
+
+func (s *Server) handleAttachment(r *http.Request) (interface{}, error) {
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	att := &Attachment{ID: s.newID(), FileName: header.Filename, MediaType: "general", Size: len(data)}
+	if strings.HasPrefix(http.DetectContentType(data), "image/") {
+		att.MediaType = "image"
+	}
+	s.attachments[att.ID] = att
+	return map[string]interface{}{"attachments": map[string]string{"id": att.ID, "mediaType": att.MediaType}}, nil
+}
+
+func (s *Server) handleUpdate(user *User, kind string, id string, body io.Reader) (interface{}, error) {
+	req := map[string]struct {
+		Body string `json:"body"`
+	}{}
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		return nil, err
+	}
+
+	s.lk.Lock()
+	var (
+		post  *Post
+		event interface{}
+	)
+	if kind == "post" {
+		post = s.posts[id]
+		if post == nil {
+			s.lk.Unlock()
+			return nil, errNotFound
+		}
+		if post.AuthorID != user.ID {
+			s.lk.Unlock()
+			return nil, errForbidden
+		}
+		post.Body = req["post"].Body
+		event = s.postJSON(post, false)
+	} else {
+		comment := s.comments[id]
+		if comment == nil {
+			s.lk.Unlock()
+			return nil, errNotFound
+		}
+		if comment.AuthorID != user.ID {
+			s.lk.Unlock()
+			return nil, errForbidden
+		}
+		comment.Body = req["comment"].Body
+		post = s.posts[comment.PostID]
+		event = s.commentJSON(comment)
+	}
+	s.lk.Unlock()
+
+	s.emit(post, kind+":update", event)
+	return map[string]interface{}{}, nil
+}
+
+func (s *Server) handleDelete(user *User, kind string, id string) (interface{}, error) {
+	s.lk.Lock()
+	var (
+		post  *Post
+		event interface{}
+	)
+	if kind == "post" {
+		post = s.posts[id]
+		if post == nil {
+			s.lk.Unlock()
+			return nil, errNotFound
+		}
+		if post.AuthorID != user.ID {
+			s.lk.Unlock()
+			return nil, errForbidden
+		}
+		delete(s.posts, id)
+		event = map[string]interface{}{"meta": map[string]string{"postId": id}}
+	} else {
+		comment := s.comments[id]
+		if comment == nil {
+			s.lk.Unlock()
+			return nil, errNotFound
+		}
+		post = s.posts[comment.PostID]
+		if comment.AuthorID != user.ID && post.AuthorID != user.ID {
+			s.lk.Unlock()
+			return nil, errForbidden
+		}
+		delete(s.comments, id)
+		ids := []string{}
+		for _, cid := range post.CommentIDs {
+			if cid != id {
+				ids = append(ids, cid)
+			}
+		}
+		post.CommentIDs = ids
+		event = map[string]string{"postId": post.ID, "commentId": id}
+	}
+	s.lk.Unlock()
+
+	s.emit(post, kind+":destroy", event)
+	return map[string]interface{}{}, nil
+}
+
+// handleLike ставит или снимает лайк. Как и во FreeFeed, свой пост лайкать нельзя, как и лайкать дважды.
+func (s *Server) handleLike(user *User, postID string, like bool) (interface{}, error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	post := s.posts[postID]
+	if post == nil || !s.canRead(user, post) {
+		return nil, errNotFound
+	}
+	likes := []string{}
+	liked := false
+	for _, id := range post.Likes {
+		if id == user.ID {
+			liked = true
+		} else {
+			likes = append(likes, id)
+		}
+	}
+	if post.AuthorID == user.ID || like == liked {
+		return nil, errForbidden
+	}
+	if like {
+		likes = append(likes, user.ID)
+	}
+	post.Likes = likes
+	return map[string]interface{}{}, nil
+}
+
+/////////////////////
+// Сериализация в формате API FreeFeed. Вызывается под s.lk.
+
+// staff — справочники пользователей, лент и аттачментов, которые прилагаются к ответам
+func (s *Server) staff() map[string]interface{} {
+	users := []map[string]string{}
+	feeds := []map[string]string{}
+	for _, u := range s.users {
+		users = append(users, map[string]string{"id": u.ID, "username": u.Name})
+		feeds = append(feeds,
+			map[string]string{"id": u.DirectsFeedID, "name": "Directs", "user": u.ID},
+			map[string]string{"id": u.PostsFeedID, "name": "Posts", "user": u.ID},
+		)
+	}
+	atts := []map[string]string{}
+	for _, a := range s.attachments {
+		atts = append(atts, map[string]string{
+			"id":        a.ID,
+			"fileName":  a.FileName,
+			"mediaType": a.MediaType,
+			"url":       "https://media.example.com/attachments/" + a.ID,
+		})
+	}
+	return map[string]interface{}{
+		"users":         users,
+		"subscribers":   users,
+		"subscriptions": feeds,
+		"attachments":   atts,
+	}
+}
+
+func (s *Server) postObject(p *Post) map[string]interface{} {
+	return map[string]interface{}{
+		"id":          p.ID,
+		"createdBy":   p.AuthorID,
+		"body":        p.Body,
+		"postedTo":    p.FeedIDs,
+		"attachments": nonNil(p.AttachmentIDs),
+		"comments":    nonNil(p.CommentIDs),
+		"likes":       nonNil(p.Likes),
+		"createdAt":   strconv.FormatInt(p.CreatedAt, 10),
+		"bumpedAt":    strconv.FormatInt(p.BumpedAt, 10),
+	}
+}
+
+func (s *Server) postJSON(p *Post, withComments bool) map[string]interface{} {
+	resp := s.staff()
+	resp["posts"] = s.postObject(p)
+	comments := []interface{}{}
+	if withComments {
+		for _, id := range p.CommentIDs {
+			comments = append(comments, s.commentObject(s.comments[id]))
+		}
+	}
+	resp["comments"] = comments
+	return resp
+}
+
+func (s *Server) commentObject(c *Comment) map[string]string {
+	return map[string]string{
+		"id":        c.ID,
+		"postId":    c.PostID,
+		"body":      c.Body,
+		"createdBy": c.AuthorID,
+		"createdAt": strconv.FormatInt(c.CreatedAt, 10),
+	}
+}
+
+func (s *Server) commentJSON(c *Comment) map[string]interface{} {
+	resp := s.staff()
+	resp["comments"] = s.commentObject(c)
+	return resp
+}
+
+func nonNil(ids []string) []string {
+	if ids == nil {
+		return []string{}
+	}
+	return ids
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
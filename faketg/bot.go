@@ -0,0 +1,411 @@
+// Package faketg — поддельный Telegram Bot API для проверки бота без Telegram.
+// Сообщения «пользователей» подаются скриптом и приходят боту через getUpdates,
+// а всё, что бот отправляет, записывается и может быть проверено.
+package faketg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Так Telegram отвечает, если пользователь заблокировал бота
+var ErrBlocked = tgbotapi.Error{Message: "Forbidden: bot was blocked by the user"}
+
+// TooManyRequests — ответ Telegram при превышении лимитов
+func TooManyRequests(retryAfter int) error {
+	return tgbotapi.Error{
+		Message:            "Too Many Requests: retry after " + strconv.Itoa(retryAfter),
+		ResponseParameters: tgbotapi.ResponseParameters{RetryAfter: retryAfter},
+	}
+}
+
+// Sent — записанное исходящее сообщение бота
+type Sent struct {
+	Kind      string // message, edit text, edit markup, photo, document, media group, другое — имя метода
+	ChatID    int64
+	MessageID int // номер отправленного или редактируемого сообщения
+	Text      string
+	Markup    *tgbotapi.InlineKeyboardMarkup
+	Raw       tgbotapi.Chattable
+}
+
+// Buttons возвращает данные (или URL) кнопок клавиатуры по их подписям
+func (s *Sent) Buttons() map[string]string {
+	out := map[string]string{}
+	if s.Markup == nil {
+		return out
+	}
+	for _, row := range s.Markup.InlineKeyboard {
+		for _, b := range row {
+			switch {
+			case b.CallbackData != nil:
+				out[b.Text] = *b.CallbackData
+			case b.URL != nil:
+				out[b.Text] = *b.URL
+			}
+		}
+	}
+	return out
+}
+
+type update struct {
+	id   int
+	data json.RawMessage
+}
+
+type Bot struct {
+	// Files — прямые ссылки на файлы для GetFileDirectURL, по FileID
+	Files map[string]string
+
+	lk          sync.Mutex
+	updates     []update
+	lastUpdate  int
+	lastMessage int
+	sent        []*Sent
+	answers     []tgbotapi.CallbackConfig
+	blocked     map[int64]bool
+	admins      map[int64]map[int64]bool // администраторы групп
+	failures    []error
+	newUpdates  chan struct{}
+	newSent     chan struct{}
+}
+
+func New() *Bot {
+	return &Bot{
+		Files:      make(map[string]string),
+		blocked:    make(map[int64]bool),
+		admins:     make(map[int64]map[int64]bool),
+		newUpdates: make(chan struct{}, 1),
+		newSent:    make(chan struct{}, 1),
+	}
+}
+
+/////////////////////
+// Действия пользователей
+
+// Say — пользователь userID пишет боту text. Возвращает номер сообщения.
+func (b *Bot) Say(userID int64, text string) int {
+	return b.sayMessage(userID, text, 0, "message")
+}
+
+// Reply — пользователь отвечает (Reply) на сообщение бота replyTo
+func (b *Bot) Reply(userID int64, replyTo int, text string) int {
+	return b.sayMessage(userID, text, replyTo, "message")
+}
+
+// SayInGroup — пользователь userID пишет text в группу chatID (у групп отрицательные номера)
+func (b *Bot) SayInGroup(chatID, userID int64, text string) int {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	b.lastMessage++
+	msg := b.message(userID, b.lastMessage, text, 0)
+	msg.Chat = &tgbotapi.Chat{ID: chatID, Type: "supergroup", Title: "Group " + strconv.FormatInt(-chatID, 10)}
+	b.push(map[string]interface{}{"message": msg})
+	return b.lastMessage
+}
+
+// Edit — пользователь редактирует своё сообщение messageID
+func (b *Bot) Edit(userID int64, messageID int, text string) {
+	b.lk.Lock()
+	msg := b.message(userID, messageID, text, 0)
+	b.push(map[string]interface{}{"edited_message": msg})
+	b.lk.Unlock()
+}
+
+// SendPhoto — пользователь присылает фото fileID с подписью caption
+func (b *Bot) SendPhoto(userID int64, fileID string, caption string) int {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	b.lastMessage++
+	msg := b.message(userID, b.lastMessage, "", 0)
+	msg.Caption = caption
+	msg.Photo = &[]tgbotapi.PhotoSize{{FileID: fileID, Width: 100, Height: 100}}
+	b.push(map[string]interface{}{"message": msg})
+	return b.lastMessage
+}
+
+// Press — пользователь нажимает кнопку с данными data под сообщением бота messageID
+func (b *Bot) Press(userID int64, messageID int, data string) {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	b.push(map[string]interface{}{"callback_query": &tgbotapi.CallbackQuery{
+		ID:      "cq" + strconv.Itoa(b.lastUpdate+1),
+		From:    &tgbotapi.User{ID: int(userID)},
+		Message: &tgbotapi.Message{MessageID: messageID, Chat: &tgbotapi.Chat{ID: userID, Type: "private"}},
+		Data:    data,
+	}})
+}
+
+// Block — пользователь блокирует бота: отправка в его чат начинает возвращать ErrBlocked
+func (b *Bot) Block(userID int64) {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	b.blocked[userID] = true
+	b.push(map[string]interface{}{"my_chat_member": b.memberUpdate(userID, "member", "kicked")})
+}
+
+// Unblock — пользователь разблокирует бота (и, как обычно, присылает /start)
+func (b *Bot) Unblock(userID int64) {
+	b.lk.Lock()
+	delete(b.blocked, userID)
+	b.push(map[string]interface{}{"my_chat_member": b.memberUpdate(userID, "kicked", "member")})
+	b.lk.Unlock()
+	b.Say(userID, "/start")
+}
+
+// MakeAdmin делает пользователя userID администратором группы chatID
+func (b *Bot) MakeAdmin(chatID, userID int64) {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	if b.admins[chatID] == nil {
+		b.admins[chatID] = make(map[int64]bool)
+	}
+	b.admins[chatID][userID] = true
+}
+
+// FailNext заставляет следующие вызовы Send вернуть ошибки errs (по одной на вызов)
+func (b *Bot) FailNext(errs ...error) {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	b.failures = append(b.failures, errs...)
+}
+
+func (b *Bot) sayMessage(userID int64, text string, replyTo int, kind string) int {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	b.lastMessage++
+	b.push(map[string]interface{}{kind: b.message(userID, b.lastMessage, text, replyTo)})
+	return b.lastMessage
+}
+
+func (b *Bot) message(userID int64, messageID int, text string, replyTo int) *tgbotapi.Message {
+	msg := &tgbotapi.Message{
+		MessageID: messageID,
+		From:      &tgbotapi.User{ID: int(userID)},
+		Chat:      &tgbotapi.Chat{ID: userID, Type: "private"},
+		Date:      int(time.Now().Unix()),
+		Text:      text,
+	}
+	if strings.HasPrefix(text, "/") {
+		cmdLen := len(text)
+		if i := strings.IndexByte(text, ' '); i > 0 {
+			cmdLen = i
+		}
+		msg.Entities = &[]tgbotapi.MessageEntity{{Type: "bot_command", Offset: 0, Length: cmdLen}}
+	}
+	if replyTo != 0 {
+		msg.ReplyToMessage = b.sentMessage(replyTo)
+	}
+	return msg
+}
+
+// sentMessage восстанавливает сообщение бота, на которое отвечает пользователь
+func (b *Bot) sentMessage(messageID int) *tgbotapi.Message {
+	for _, s := range b.sent {
+		if s.MessageID == messageID {
+			return &tgbotapi.Message{MessageID: messageID, Chat: &tgbotapi.Chat{ID: s.ChatID}, Text: s.Text}
+		}
+	}
+	return &tgbotapi.Message{MessageID: messageID}
+}
+
+func (b *Bot) memberUpdate(userID int64, from, to string) map[string]interface{} {
+	return map[string]interface{}{
+		"chat":            &tgbotapi.Chat{ID: userID, Type: "private"},
+		"from":            &tgbotapi.User{ID: int(userID)},
+		"date":            time.Now().Unix(),
+		"old_chat_member": map[string]interface{}{"status": from},
+		"new_chat_member": map[string]interface{}{"status": to},
+	}
+}
+
+// push добавляет обновление в очередь getUpdates. Вызывается под b.lk.
+func (b *Bot) push(u map[string]interface{}) {
+	b.lastUpdate++
+	u["update_id"] = b.lastUpdate
+	data, _ := json.Marshal(u)
+	b.updates = append(b.updates, update{id: b.lastUpdate, data: data})
+	select {
+	case b.newUpdates <- struct{}{}:
+	default:
+	}
+}
+
+/////////////////////
+// Проверка ответов бота
+
+var ErrTimeout = errors.New("Bot did not answer in time")
+
+// Sent возвращает все сообщения, отправленные ботом
+func (b *Bot) Sent() []*Sent {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	return append([]*Sent(nil), b.sent...)
+}
+
+// Answers возвращает ответы бота на нажатия кнопок
+func (b *Bot) Answers() []tgbotapi.CallbackConfig {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	return append([]tgbotapi.CallbackConfig(nil), b.answers...)
+}
+
+// WaitSent ждёт, пока бот отправит не меньше n сообщений (всего), и возвращает их
+func (b *Bot) WaitSent(n int, timeout time.Duration) ([]*Sent, error) {
+	deadline := time.After(timeout)
+	for {
+		sent := b.Sent()
+		if len(sent) >= n {
+			return sent, nil
+		}
+		select {
+		case <-b.newSent:
+		case <-deadline:
+			return sent, ErrTimeout
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+/////////////////////
+// Реализация Bot API
+
+func (b *Bot) Send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	s := describe(c)
+
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	if len(b.failures) > 0 {
+		err := b.failures[0]
+		b.failures = b.failures[1:]
+		return tgbotapi.Message{}, err
+	}
+	if b.blocked[s.ChatID] {
+		return tgbotapi.Message{}, ErrBlocked
+	}
+	if s.MessageID == 0 {
+		b.lastMessage++
+		s.MessageID = b.lastMessage
+	}
+	b.sent = append(b.sent, s)
+	select {
+	case b.newSent <- struct{}{}:
+	default:
+	}
+	return tgbotapi.Message{MessageID: s.MessageID, Chat: &tgbotapi.Chat{ID: s.ChatID}, Text: s.Text}, nil
+}
+
+func (b *Bot) AnswerCallbackQuery(config tgbotapi.CallbackConfig) (tgbotapi.APIResponse, error) {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	b.answers = append(b.answers, config)
+	return tgbotapi.APIResponse{Ok: true}, nil
+}
+
+func (b *Bot) AnswerInlineQuery(config tgbotapi.InlineConfig) (tgbotapi.APIResponse, error) {
+	return tgbotapi.APIResponse{Ok: true}, nil
+}
+
+func (b *Bot) GetFileDirectURL(fileID string) (string, error) {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	if u, ok := b.Files[fileID]; ok {
+		return u, nil
+	}
+	return "", tgbotapi.Error{Message: "Bad Request: invalid file_id"}
+}
+
+// GetChatMember считает всех, кроме назначенных MakeAdmin, обычными участниками
+func (b *Bot) GetChatMember(config tgbotapi.ChatConfigWithUser) (tgbotapi.ChatMember, error) {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	m := tgbotapi.ChatMember{User: &tgbotapi.User{ID: config.UserID}, Status: "member"}
+	if b.admins[config.ChatID][int64(config.UserID)] {
+		m.Status = "administrator"
+	}
+	return m, nil
+}
+
+// MakeRequest поддерживает только getUpdates: отдаёт накопившиеся обновления
+// или ждёт их не дольше секунды (настоящий long polling ждал бы timeout секунд)
+func (b *Bot) MakeRequest(endpoint string, params url.Values) (tgbotapi.APIResponse, error) {
+	if endpoint != "getUpdates" {
+		return tgbotapi.APIResponse{}, fmt.Errorf("faketg: unsupported method %s", endpoint)
+	}
+	offset, _ := strconv.Atoi(params.Get("offset"))
+	deadline := time.After(time.Second)
+	for {
+		b.lk.Lock()
+		var out []json.RawMessage
+		for _, u := range b.updates {
+			if u.id >= offset {
+				out = append(out, u.data)
+			}
+		}
+		b.lk.Unlock()
+		if len(out) > 0 {
+			data, _ := json.Marshal(out)
+			return tgbotapi.APIResponse{Ok: true, Result: data}, nil
+		}
+		select {
+		case <-b.newUpdates:
+		case <-deadline:
+			return tgbotapi.APIResponse{Ok: true, Result: json.RawMessage("[]")}, nil
+		}
+	}
+}
+
+// describe извлекает из исходящего сообщения чат, текст и клавиатуру. Методы Chattable
+// не экспортированы, поэтому поля читаются через JSON — так работают и обёртки
+// над типами библиотеки.
+func describe(c tgbotapi.Chattable) *Sent {
+	s := &Sent{Raw: c}
+	switch c.(type) {
+	case tgbotapi.MessageConfig:
+		s.Kind = "message"
+	case tgbotapi.EditMessageTextConfig:
+		s.Kind = "edit text"
+	case tgbotapi.EditMessageReplyMarkupConfig:
+		s.Kind = "edit markup"
+	case tgbotapi.PhotoConfig:
+		s.Kind = "photo"
+	case tgbotapi.DocumentConfig:
+		s.Kind = "document"
+	case tgbotapi.MediaGroupConfig:
+		s.Kind = "media group"
+	}
+
+	fields := &struct {
+		ChatID      int64
+		MessageID   int
+		Text        string
+		Caption     string
+		FileID      string
+		ReplyMarkup json.RawMessage
+	}{}
+	data, _ := json.Marshal(c)
+	json.Unmarshal(data, fields)
+	s.ChatID, s.MessageID, s.Text = fields.ChatID, fields.MessageID, fields.Text
+	if s.Text == "" {
+		s.Text = fields.Caption
+	}
+	if s.Kind == "" && fields.Text != "" {
+		// обёртка над MessageConfig
+		s.Kind = "message"
+	}
+	if len(fields.ReplyMarkup) > 0 && string(fields.ReplyMarkup) != "null" {
+		m := &tgbotapi.InlineKeyboardMarkup{}
+		if json.Unmarshal(fields.ReplyMarkup, m) == nil && m.InlineKeyboard != nil {
+			s.Markup = m
+		}
+	}
+	return s
+}
@@ -0,0 +1,91 @@
+package faketg
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Step — шаг сценария: пользователь что-то пишет или бот должен что-то ответить
+type Step struct {
+	User   int64       // пользователь, от имени которого пишется Say, или которому адресован ответ
+	Say    string      // сообщение пользователя
+	Expect string      // ожидаемый текст ответа бота; "*" в конце — проверять только начало
+	Until  func() bool // условие, которого надо дождаться; тогда Expect — его описание
+}
+
+// Say, Expect и Wait — сокращения для записи сценариев
+func Say(userID int64, text string) Step    { return Step{User: userID, Say: text} }
+func Expect(userID int64, text string) Step { return Step{User: userID, Expect: text} }
+
+// Wait ждёт, пока бот не закончит обработку: ответить он может раньше, чем, например, сохранит состояние
+func Wait(what string, cond func() bool) Step { return Step{Expect: what, Until: cond} }
+
+// Run проигрывает сценарий. Ответы бота сверяются по порядку в пределах каждого чата;
+// на каждый ответ даётся не больше timeout. Возвращает первое расхождение.
+func (b *Bot) Run(steps []Step, timeout time.Duration) error {
+	seen := map[int64]int{} // сколько ответов в чате уже проверено; отправленное до сценария не в счёт
+	for _, s := range b.Sent() {
+		seen[s.ChatID]++
+	}
+	for i, st := range steps {
+		if st.Say != "" {
+			b.Say(st.User, st.Say)
+			continue
+		}
+		if st.Until != nil {
+			if !waitUntil(st.Until, timeout) {
+				return fmt.Errorf("step %d: expected %s, %v", i, st.Expect, ErrTimeout)
+			}
+			continue
+		}
+		got, err := b.nextInChat(st.User, seen[st.User], timeout)
+		if err != nil {
+			return fmt.Errorf("step %d: expected %q, %v", i, st.Expect, err)
+		}
+		seen[st.User]++
+		if !matches(got.Text, st.Expect) {
+			return fmt.Errorf("step %d: expected %q, got %q", i, st.Expect, got.Text)
+		}
+	}
+	return nil
+}
+
+// nextInChat ждёт n-е (с нуля) сообщение бота в чате chatID
+func (b *Bot) nextInChat(chatID int64, n int, timeout time.Duration) (*Sent, error) {
+	deadline := time.After(timeout)
+	for {
+		var inChat []*Sent
+		for _, s := range b.Sent() {
+			if s.ChatID == chatID {
+				inChat = append(inChat, s)
+			}
+		}
+		if len(inChat) > n {
+			return inChat[n], nil
+		}
+		select {
+		case <-b.newSent:
+		case <-deadline:
+			return nil, ErrTimeout
+		case <-time.After(50 * time.Millisecond):
+			// newSent один на всех ожидающих, поэтому на всякий случай перепроверяем
+		}
+	}
+}
+
+func waitUntil(cond func() bool, timeout time.Duration) bool {
+	for deadline := time.Now().Add(timeout); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			return false
+		}
+	}
+	return true
+}
+
+func matches(text, pattern string) bool {
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(text, strings.TrimSuffix(pattern, "*"))
+	}
+	return text == pattern
+}
@@ -0,0 +1,333 @@
+package frf
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrUnauthorized = errors.New("Unauthorized")
+	ErrForbidden    = errors.New("Forbidden")
+	ErrNotFound     = errors.New("Not Found")
+	ErrTimeout      = errors.New("FreeFeed API timeout")
+)
+
+// Is позволяет проверять ответы сервера через errors.Is(err, frf.ErrNotFound) и т. п.
+func (e *ErrorResponse) Is(target error) bool {
+	switch target {
+	case ErrUnauthorized:
+		return e.HTTPStatusCode == http.StatusUnauthorized
+	case ErrForbidden:
+		return e.HTTPStatusCode == http.StatusForbidden
+	case ErrNotFound:
+		return e.HTTPStatusCode == http.StatusNotFound
+	}
+	return false
+}
+
+// Client выполняет запросы к API FreeFeed от имени пользователя User
+type Client struct {
+	BaseURL    string // схема и хост инстанса, например https://freefeed.net
+	User       *User
+	HTTPClient *http.Client  // nil — http.DefaultClient
+	Timeout    time.Duration // ограничение времени одного запроса (для загрузки файлов — простоя); 0 — только то, что задано в ctx
+	UserAgent  string
+
+	// OnUnauthorized вызывается, если сервер отверг токен пользователя; ctx — контекст запроса
+	OnUnauthorized func(ctx context.Context)
+}
+
+func NewClient(baseURL string, user *User) *Client {
+	return &Client{BaseURL: baseURL, User: user}
+}
+
+func (c *Client) WhoAmI(ctx context.Context) (*WhoAmIResponse, error) {
+	v := new(WhoAmIResponse)
+	if err := c.do(ctx, "GET", "/v2/users/whoami", nil, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Directs возвращает страницу ленты директов, начиная с offset
+func (c *Client) Directs(ctx context.Context, offset int) (*DirectChannelResponse, error) {
+	v := new(DirectChannelResponse)
+	if err := c.do(ctx, "GET", "/v2/timelines/filter/directs?offset="+strconv.Itoa(offset), nil, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Pager возвращает постраничное чтение директов; все запросы выполняются с контекстом ctx
+func (c *Client) Pager(ctx context.Context, offset int) *DirectsPager {
+	return NewDirectsPager(offset, func(offset int) (*DirectChannelResponse, error) {
+		return c.Directs(ctx, offset)
+	})
+}
+
+func (c *Client) MarkAllDirectsAsRead(ctx context.Context) error {
+	return c.do(ctx, "GET", "/v2/users/markAllDirectsAsRead", nil, nil)
+}
+
+// GetPost возвращает пост с несколькими первыми и последними комментариями
+func (c *Client) GetPost(ctx context.Context, postID string) (*Post, error) {
+	v := new(OnePostResponse)
+	if err := c.do(ctx, "GET", "/v2/posts/"+postID, nil, v); err != nil {
+		return nil, err
+	}
+	return v.GetPost(), nil
+}
+
+// GetThread возвращает пост со всеми комментариями
+func (c *Client) GetThread(ctx context.Context, postID string) (*Post, error) {
+	v := new(OnePostResponse)
+	if err := c.do(ctx, "GET", "/v2/posts/"+postID+"?maxComments=all", nil, v); err != nil {
+		return nil, err
+	}
+	return v.GetPost(), nil
+}
+
+// CreatePost публикует пост в ленты feeds (для директа — имена адресатов) и возвращает его ID
+func (c *Client) CreatePost(ctx context.Context, feeds []string, body string, attachments []string) (string, error) {
+	req := new(NewPostRequest)
+	req.Meta.Feeds = feeds
+	req.Post.Body = body
+	req.Post.Attachments = attachments
+	v := new(PostResponse)
+	if err := c.do(ctx, "POST", "/v1/posts", req, v); err != nil {
+		return "", err
+	}
+	if v.Posts == nil {
+		return "", ErrNotFound
+	}
+	return v.Posts.ID, nil
+}
+
+func (c *Client) UpdatePost(ctx context.Context, postID, body string) error {
+	req := new(UpdatePostRequest)
+	req.Post.Body = body
+	return c.do(ctx, "PUT", "/v1/posts/"+postID, req, nil)
+}
+
+func (c *Client) DeletePost(ctx context.Context, postID string) error {
+	return c.do(ctx, "DELETE", "/v1/posts/"+postID, nil, nil)
+}
+
+// CreateComment добавляет комментарий к посту и возвращает его ID (пустой, если сервер его не сообщил)
+func (c *Client) CreateComment(ctx context.Context, postID, body string) (string, error) {
+	req := new(NewCommentRequest)
+	req.Comment.Body = body
+	req.Comment.PostID = postID
+	v := new(CommentResponse)
+	if err := c.do(ctx, "POST", "/v1/comments", req, v); err != nil {
+		return "", err
+	}
+	if v.Comments == nil {
+		return "", nil
+	}
+	return v.Comments.ID, nil
+}
+
+func (c *Client) UpdateComment(ctx context.Context, commentID, body string) error {
+	req := new(UpdateCommentRequest)
+	req.Comment.Body = body
+	return c.do(ctx, "PUT", "/v1/comments/"+commentID, req, nil)
+}
+
+func (c *Client) DeleteComment(ctx context.Context, commentID string) error {
+	return c.do(ctx, "DELETE", "/v1/comments/"+commentID, nil, nil)
+}
+
+func (c *Client) Like(ctx context.Context, postID string) error {
+	return c.do(ctx, "POST", "/v1/posts/"+postID+"/like", nil, nil)
+}
+
+func (c *Client) Unlike(ctx context.Context, postID string) error {
+	return c.do(ctx, "POST", "/v1/posts/"+postID+"/unlike", nil, nil)
+}
+
+// UploadAttachment загружает файл и возвращает ID аттачмента
+func (c *Client) UploadAttachment(ctx context.Context, fileName string, content io.Reader) (string, error) {
+	v := new(AttachmentResponse)
+	upload := &FileUpload{FieldName: "file", FileName: fileName, Content: content}
+	if err := c.do(ctx, "POST", "/v1/attachments", upload, v); err != nil {
+		return "", err
+	}
+	if v.Attachments == nil {
+		return "", ErrNotFound
+	}
+	return v.Attachments.ID, nil
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// do выполняет запрос. Ошибки: *ErrorResponse для ответов с кодом, отличным от 200,
+// ErrTimeout, если сервер не ответил вовремя, или ошибка контекста при отмене.
+func (c *Client) do(ctx context.Context, method string, uri string, reqObj interface{}, respObj interface{}) error {
+	upload, isUpload := reqObj.(*FileUpload)
+	var idle *idleTimer
+	if c.Timeout > 0 && isUpload {
+		// большой файл может грузиться долго, поэтому ограничиваем не весь запрос, а простой
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		idle = newIdleTimer(c.Timeout, cancel)
+		defer idle.Stop()
+	} else if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	url := c.BaseURL + uri
+	var (
+		body        io.Reader
+		contentType string
+	)
+	if isUpload {
+		content := upload.Content
+		if idle != nil {
+			content = idle.Reader(content)
+		}
+		// файл может быть большим, поэтому передаём его потоком
+		r, w := io.Pipe()
+		// если запрос не прочитает тело до конца, горутина не должна остаться висеть на записи
+		defer r.Close()
+		// транспорт при отмене ждёт, пока дочитается тело, а источник файла может стоять — закрываем трубу сами
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-ctx.Done():
+				r.CloseWithError(ctx.Err())
+			case <-stop:
+			}
+		}()
+		mw := multipart.NewWriter(w)
+		go func() {
+			part, err := mw.CreateFormFile(upload.FieldName, upload.FileName)
+			if err == nil {
+				_, err = io.Copy(part, content)
+			}
+			if err == nil {
+				err = mw.Close()
+			}
+			w.CloseWithError(err)
+		}()
+		body, contentType = r, mw.FormDataContentType()
+	} else if reqObj != nil {
+		buf := new(bytes.Buffer)
+		if err := json.NewEncoder(buf).Encode(reqObj); err != nil {
+			return err
+		}
+		body, contentType = buf, "application/json; charset=utf-8"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Add("Content-Type", contentType)
+	}
+	if c.UserAgent != "" {
+		req.Header.Set("User-Agent", c.UserAgent)
+	}
+	c.User.Sign(req)
+
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		if idle.Expired() {
+			return ErrTimeout
+		}
+		return c.requestError(ctx, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err := ReadErrorResponse(resp)
+		log.Println("Error:", err, "while send", method, "request to", url)
+		if resp.StatusCode == http.StatusUnauthorized && c.OnUnauthorized != nil {
+			c.OnUnauthorized(ctx)
+		}
+		return err
+	}
+
+	if respObj != nil {
+		if err := json.NewDecoder(resp.Body).Decode(respObj); err != nil {
+			if idle.Expired() {
+				return ErrTimeout
+			}
+			return c.requestError(ctx, err)
+		}
+	}
+	return nil
+}
+
+// requestError отличает истёкшее время ожидания от прочих сетевых ошибок
+func (c *Client) requestError(ctx context.Context, err error) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return ErrTimeout
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return ErrTimeout
+	}
+	return err
+}
+
+// idleTimer вызывает cancel, если за timeout не было передано ни байта
+type idleTimer struct {
+	timer   *time.Timer
+	timeout time.Duration
+	expired int32
+}
+
+func newIdleTimer(timeout time.Duration, cancel func()) *idleTimer {
+	t := &idleTimer{timeout: timeout}
+	t.timer = time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&t.expired, 1)
+		cancel()
+	})
+	return t
+}
+
+func (t *idleTimer) Stop() { t.timer.Stop() }
+
+// Expired сообщает, что запрос отменён из-за простоя; для nil — false
+func (t *idleTimer) Expired() bool { return t != nil && atomic.LoadInt32(&t.expired) == 1 }
+
+// Reader продлевает таймер при каждом чтении из r. После того как файл прочитан,
+// таймер ограничивает ожидание ответа сервера.
+func (t *idleTimer) Reader(r io.Reader) io.Reader { return &idleReader{r, t} }
+
+type idleReader struct {
+	r     io.Reader
+	timer *idleTimer
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.timer.timer.Reset(r.timer.timeout)
+	}
+	return n, err
+}
@@ -0,0 +1,230 @@
+package frf
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// slowReader отдаёт по байту раз в delay, а после stall байт замирает навсегда
+type slowReader struct {
+	n, stall int
+	delay    time.Duration
+	done     chan struct{}
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	if r.n == r.stall {
+		<-r.done
+		return 0, io.ErrUnexpectedEOF
+	}
+	time.Sleep(r.delay)
+	r.n++
+	if r.n > 10 {
+		return 0, io.EOF
+	}
+	p[0] = 'x'
+	return 1, nil
+}
+
+func uploadServer(t *testing.T) *Client {
+	t.Helper()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.Write([]byte(`{"attachments":{"id":"att1"}}`))
+	}))
+	t.Cleanup(ts.Close)
+	c := NewClient(ts.URL, &User{Name: "alice", AccessToken: "token"})
+	c.Timeout = 50 * time.Millisecond
+	return c
+}
+
+// загрузка, которая идёт дольше Timeout, но без простоев, не прерывается
+func TestUploadLongerThanTimeout(t *testing.T) {
+	c := uploadServer(t)
+	r := &slowReader{stall: -1, delay: 20 * time.Millisecond}
+	id, err := c.UploadAttachment(context.Background(), "file", r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "att1" {
+		t.Errorf("got attachment %q", id)
+	}
+}
+
+func TestUploadStalled(t *testing.T) {
+	c := uploadServer(t)
+	r := &slowReader{stall: 3, delay: time.Millisecond, done: make(chan struct{})}
+	defer close(r.done)
+	if _, err := c.UploadAttachment(context.Background(), "file", r); err != ErrTimeout {
+		t.Errorf("got %v, want %v", err, ErrTimeout)
+	}
+}
+
+// apiRequest — запрос, полученный тестовым сервером
+type apiRequest struct {
+	Method, URI, Body, Auth, ContentType string
+}
+
+// apiServer отвечает на запросы телами из responses (по методу и URI, например "GET /v1/x"),
+// на остальные — пустым объектом; requests возвращает полученные запросы
+func apiServer(t *testing.T, responses map[string]string) (client *Client, requests func() []apiRequest) {
+	t.Helper()
+	var (
+		lk       sync.Mutex
+		received []apiRequest
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		lk.Lock()
+		received = append(received, apiRequest{r.Method, r.URL.RequestURI(), string(body), r.Header.Get("Authorization"), r.Header.Get("Content-Type")})
+		lk.Unlock()
+		if resp, ok := responses[r.Method+" "+r.URL.RequestURI()]; ok {
+			w.Write([]byte(resp))
+		} else {
+			w.Write([]byte(`{}`))
+		}
+	}))
+	t.Cleanup(ts.Close)
+	return NewClient(ts.URL, &User{Name: "alice", AccessToken: "token"}), func() []apiRequest {
+		lk.Lock()
+		defer lk.Unlock()
+		return append([]apiRequest(nil), received...)
+	}
+}
+
+func TestClientRequests(t *testing.T) {
+	ctx := context.Background()
+	client, requests := apiServer(t, map[string]string{
+		"POST /v1/posts":    `{"posts":{"id":"post1"}}`,
+		"POST /v1/comments": `{"comments":{"id":"comment1","postId":"post1"}}`,
+		"GET /v2/posts/post1": `{"posts":{"id":"post1","body":"Привет","createdBy":"u1"},` +
+			`"users":[{"id":"u1","username":"bob"}]}`,
+	})
+
+	for _, c := range []struct {
+		call   func() error
+		method string
+		uri    string
+		body   string
+	}{
+		{func() error { _, err := client.WhoAmI(ctx); return err }, "GET", "/v2/users/whoami", ""},
+		{func() error { _, err := client.Directs(ctx, 30); return err }, "GET", "/v2/timelines/filter/directs?offset=30", ""},
+		{func() error { return client.MarkAllDirectsAsRead(ctx) }, "GET", "/v2/users/markAllDirectsAsRead", ""},
+		{func() error {
+			p, err := client.GetPost(ctx, "post1")
+			if err == nil && (p.ID != "post1" || p.Body != "Привет" || p.Author != "bob") {
+				t.Errorf("unexpected post %+v", p)
+			}
+			return err
+		}, "GET", "/v2/posts/post1", ""},
+		{func() error { _, err := client.GetThread(ctx, "post2"); return err }, "GET", "/v2/posts/post2?maxComments=all", ""},
+		{func() error {
+			id, err := client.CreatePost(ctx, []string{"bob", "carol"}, "Привет", []string{"att1"})
+			if err == nil && id != "post1" {
+				t.Errorf("created post %q", id)
+			}
+			return err
+		}, "POST", "/v1/posts", `{"meta":{"feeds":["bob","carol"]},"post":{"body":"Привет","attachments":["att1"]}}`},
+		{func() error { return client.UpdatePost(ctx, "post1", "Пока") }, "PUT", "/v1/posts/post1", `{"post":{"body":"Пока"}}`},
+		{func() error { return client.DeletePost(ctx, "post1") }, "DELETE", "/v1/posts/post1", ""},
+		{func() error {
+			id, err := client.CreateComment(ctx, "post1", "Ау")
+			if err == nil && id != "comment1" {
+				t.Errorf("created comment %q", id)
+			}
+			return err
+		}, "POST", "/v1/comments", `{"comment":{"body":"Ау","postId":"post1"}}`},
+		{func() error { return client.UpdateComment(ctx, "comment1", "Эй") }, "PUT", "/v1/comments/comment1", `{"comment":{"body":"Эй"}}`},
+		{func() error { return client.DeleteComment(ctx, "comment1") }, "DELETE", "/v1/comments/comment1", ""},
+		{func() error { return client.Like(ctx, "post1") }, "POST", "/v1/posts/post1/like", ""},
+		{func() error { return client.Unlike(ctx, "post1") }, "POST", "/v1/posts/post1/unlike", ""},
+	} {
+		n := len(requests())
+		if err := c.call(); err != nil {
+			t.Errorf("%s %s: %v", c.method, c.uri, err)
+			continue
+		}
+		sent := requests()
+		if len(sent) != n+1 {
+			t.Errorf("%s %s: %d requests sent", c.method, c.uri, len(sent)-n)
+			continue
+		}
+		r := sent[n]
+		if r.Method != c.method || r.URI != c.uri {
+			t.Errorf("got %s %s, want %s %s", r.Method, r.URI, c.method, c.uri)
+		}
+		if strings.TrimSpace(r.Body) != c.body {
+			t.Errorf("%s %s: body %s, want %s", c.method, c.uri, r.Body, c.body)
+		}
+		if c.body != "" && r.ContentType != "application/json; charset=utf-8" {
+			t.Errorf("%s %s: content type %q", c.method, c.uri, r.ContentType)
+		}
+		if r.Auth != "Bearer token" {
+			t.Errorf("%s %s: authorization %q", c.method, c.uri, r.Auth)
+		}
+	}
+}
+
+func TestClientUpload(t *testing.T) {
+	c, requests := apiServer(t, map[string]string{"POST /v1/attachments": `{"attachments":{"id":"att1"}}`})
+	id, err := c.UploadAttachment(context.Background(), "photo.png", strings.NewReader("PNG"))
+	if err != nil || id != "att1" {
+		t.Fatalf("UploadAttachment = %q, %v", id, err)
+	}
+	r := requests()[0]
+	if r.Method != "POST" || r.URI != "/v1/attachments" || !strings.HasPrefix(r.ContentType, "multipart/form-data") {
+		t.Fatalf("unexpected request %+v", r)
+	}
+	if !strings.Contains(r.Body, `name="file"; filename="photo.png"`) || !strings.Contains(r.Body, "PNG") {
+		t.Errorf("unexpected upload body %q", r.Body)
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	sentinels := []error{ErrUnauthorized, ErrForbidden, ErrNotFound}
+	for _, c := range []struct {
+		status int
+		want   error
+	}{
+		{http.StatusUnauthorized, ErrUnauthorized},
+		{http.StatusForbidden, ErrForbidden},
+		{http.StatusNotFound, ErrNotFound},
+		{http.StatusInternalServerError, nil},
+	} {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(c.status)
+			w.Write([]byte(`{"err":"oops"}`))
+		}))
+		client := NewClient(ts.URL, &User{Name: "alice", AccessToken: "token"})
+		unauthorized := 0
+		client.OnUnauthorized = func(context.Context) { unauthorized++ }
+
+		err := client.DeletePost(context.Background(), "post1")
+		ts.Close()
+
+		var er *ErrorResponse
+		if !errors.As(err, &er) || er.HTTPStatusCode != c.status || er.Error() != "oops" {
+			t.Errorf("%d: got %v, want ErrorResponse", c.status, err)
+		}
+		for _, s := range sentinels {
+			if is := errors.Is(err, s); is != (s == c.want) {
+				t.Errorf("%d: errors.Is(err, %v) = %v", c.status, s, is)
+			}
+		}
+		want := 0
+		if c.status == http.StatusUnauthorized {
+			want = 1
+		}
+		if unauthorized != want {
+			t.Errorf("%d: OnUnauthorized is called %d times", c.status, unauthorized)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package frf
+
+// Fetcher загружает страницу ленты директов, начиная с offset
+type Fetcher func(offset int) (*DirectChannelResponse, error)
+
+// DirectsPager постранично читает ленту директов
+type DirectsPager struct {
+	Offset int  // смещение следующей страницы
+	Done   bool // достигнута последняя страница
+	fetch  Fetcher
+}
+
+func NewDirectsPager(offset int, fetch Fetcher) *DirectsPager {
+	return &DirectsPager{Offset: offset, fetch: fetch}
+}
+
+// Next возвращает следующую страницу постов. После последней страницы Done становится true.
+func (p *DirectsPager) Next() ([]*Post, error) {
+	if p.Done {
+		return nil, nil
+	}
+	v, err := p.fetch(p.Offset)
+	if err != nil {
+		return nil, err
+	}
+	posts := v.AllPosts()
+	p.Offset += len(posts)
+	p.Done = v.IsLastPage || len(posts) == 0
+	return posts, nil
+}
+
+// Take читает страницы, пока не наберёт count постов или лента не кончится.
+// Смещение сдвигается ровно на количество возвращённых постов.
+func (p *DirectsPager) Take(count int) ([]*Post, error) {
+	start := p.Offset
+	var posts []*Post
+	for len(posts) < count && !p.Done {
+		page, err := p.Next()
+		if err != nil {
+			return nil, err
+		}
+		posts = append(posts, page...)
+	}
+	if len(posts) > count {
+		posts = posts[:count]
+		p.Offset = start + count
+		p.Done = false
+	}
+	return posts, nil
+}
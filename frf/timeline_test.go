@@ -0,0 +1,91 @@
+package frf
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// fakeDirects — лента из total постов, отдаваемая страницами по pageSize. Если lastPageFlag == false,
+// сервер не сообщает о последней странице, и конец ленты виден только по пустой странице.
+func fakeDirects(total, pageSize int, lastPageFlag bool, offsets *[]int) Fetcher {
+	return func(offset int) (*DirectChannelResponse, error) {
+		*offsets = append(*offsets, offset)
+		var posts []string
+		for i := offset; i < total && i < offset+pageSize; i++ {
+			posts = append(posts, fmt.Sprintf(`{"id":"post%d","createdBy":"u1"}`, i))
+		}
+		data := fmt.Sprintf(`{"posts":[%s],"users":[{"id":"u1","username":"alice"}],"isLastPage":%v}`,
+			strings.Join(posts, ","), lastPageFlag && offset+pageSize >= total)
+		v := new(DirectChannelResponse)
+		return v, json.Unmarshal([]byte(data), v)
+	}
+}
+
+func TestPagerDone(t *testing.T) {
+	for _, c := range []struct {
+		name         string
+		total        int
+		lastPageFlag bool
+		fetches      int
+	}{
+		{"last page flag", 25, true, 3},
+		{"full last page with flag", 20, true, 2},
+		{"empty page", 20, false, 3},
+		{"empty timeline", 0, false, 1},
+	} {
+		var offsets []int
+		p := NewDirectsPager(0, fakeDirects(c.total, 10, c.lastPageFlag, &offsets))
+		var got []*Post
+		for i := 0; !p.Done; i++ {
+			if i > 10 {
+				t.Fatalf("%s: pager never stops", c.name)
+			}
+			page, err := p.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, page...)
+		}
+		if len(got) != c.total || p.Offset != c.total || len(offsets) != c.fetches {
+			t.Errorf("%s: %d posts, offset %d, %d fetches", c.name, len(got), p.Offset, len(offsets))
+		}
+		if page, _ := p.Next(); page != nil || len(offsets) != c.fetches {
+			t.Errorf("%s: pager fetches after Done", c.name)
+		}
+	}
+}
+
+func TestPagerTake(t *testing.T) {
+	var offsets []int
+	p := NewDirectsPager(0, fakeDirects(25, 10, true, &offsets))
+
+	posts, err := p.Take(15)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(posts) != 15 || posts[14].ID != "post14" || p.Offset != 15 || p.Done {
+		t.Fatalf("Take(15): %d posts, offset %d, done %v", len(posts), p.Offset, p.Done)
+	}
+	// остаток последней загруженной страницы не теряется
+	posts, _ = p.Take(15)
+	if len(posts) != 10 || posts[0].ID != "post15" || p.Offset != 25 || !p.Done {
+		t.Fatalf("second Take(15): %d posts, offset %d, done %v", len(posts), p.Offset, p.Done)
+	}
+	if fmt.Sprint(offsets) != "[0 10 15]" {
+		t.Errorf("fetched offsets %v", offsets)
+	}
+}
+
+func TestPagerError(t *testing.T) {
+	fail := errors.New("network")
+	p := NewDirectsPager(5, func(int) (*DirectChannelResponse, error) { return nil, fail })
+	if _, err := p.Take(10); err != fail {
+		t.Errorf("got %v, want %v", err, fail)
+	}
+	if p.Offset != 5 || p.Done {
+		t.Errorf("pager moved after an error: offset %d, done %v", p.Offset, p.Done)
+	}
+}
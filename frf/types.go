@@ -2,20 +2,43 @@ package frf
 
 import (
 	"encoding/json"
+	"io"
 	"log"
 	"net/http"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"unicode/utf8"
 )
 
 type Post struct {
-	ID         string
-	Body       string
-	Author     string   // username
-	Addressees []string // usernames
+	ID          string
+	Body        string
+	Author      string   // username
+	Addressees  []string // usernames
+	Attachments []*Attachment
+	Comments    []*Comment // только если пост загружен вместе с комментариями
+	CreatedAt   int64      // unix-время в миллисекундах
+	BumpedAt    int64      // время последней активности (нового комментария), в миллисекундах
 }
 
+type Comment struct {
+	ID        string
+	Body      string
+	Author    string // username
+	CreatedAt int64  // unix-время в миллисекундах
+}
+
+type Attachment struct {
+	ID        string `json:"id"`
+	FileName  string `json:"fileName"`
+	URL       string `json:"url"`
+	MediaType string `json:"mediaType"` // image, audio или general
+}
+
+func (a *Attachment) IsImage() bool { return a.MediaType == "image" }
+
 type PostResponseStaff struct {
 	Users []struct {
 		ID   string `json:"id"`
@@ -30,6 +53,7 @@ type PostResponseStaff struct {
 		Type   string `json:"name"`
 		UserID string `json:"user"`
 	} `json:"subscriptions"`
+	Attachments []*Attachment `json:"attachments"`
 }
 
 type DirectChannelResponse struct {
@@ -39,21 +63,35 @@ type DirectChannelResponse struct {
 		UserID string `json:"user"`
 	} `json:"timelines"`
 	Posts []struct {
-		ID      string   `json:"id"`
-		UserID  string   `json:"createdBy"`
-		Body    string   `json:"body"`
-		FeedIDs []string `json:"postedTo"`
+		ID            string   `json:"id"`
+		UserID        string   `json:"createdBy"`
+		Body          string   `json:"body"`
+		FeedIDs       []string `json:"postedTo"`
+		AttachmentIDs []string `json:"attachments"`
+		CreatedAt     string   `json:"createdAt"`
+		BumpedAt      string   `json:"bumpedAt"`
 	} `json:"posts"`
+	IsLastPage bool `json:"isLastPage"`
 }
 
 type OnePostResponse struct {
 	PostResponseStaff
 	Post struct {
-		ID      string   `json:"id"`
-		UserID  string   `json:"createdBy"`
-		Body    string   `json:"body"`
-		FeedIDs []string `json:"postedTo"`
+		ID            string   `json:"id"`
+		UserID        string   `json:"createdBy"`
+		Body          string   `json:"body"`
+		FeedIDs       []string `json:"postedTo"`
+		AttachmentIDs []string `json:"attachments"`
+		CommentIDs    []string `json:"comments"`
+		CreatedAt     string   `json:"createdAt"`
+		BumpedAt      string   `json:"bumpedAt"`
 	} `json:"posts"`
+	Comments []struct {
+		ID        string `json:"id"`
+		Body      string `json:"body"`
+		UserID    string `json:"createdBy"`
+		CreatedAt string `json:"createdAt"`
+	} `json:"comments"`
 }
 
 type NewPostRequest struct {
@@ -61,10 +99,25 @@ type NewPostRequest struct {
 		Feeds []string `json:"feeds"`
 	} `json:"meta"`
 	Post struct {
-		Body string `json:"body"`
+		Body        string   `json:"body"`
+		Attachments []string `json:"attachments,omitempty"`
 	} `json:"post"`
 }
 
+// FileUpload is a request body that is sent as multipart/form-data
+type FileUpload struct {
+	FieldName string
+	FileName  string
+	Content   io.Reader
+}
+
+type AttachmentResponse struct {
+	Attachments *struct {
+		ID        string `json:"id"`
+		MediaType string `json:"mediaType"`
+	} `json:"attachments"`
+}
+
 type NewCommentRequest struct {
 	Comment struct {
 		Body   string `json:"body"`
@@ -72,6 +125,25 @@ type NewCommentRequest struct {
 	} `json:"comment"`
 }
 
+type UpdatePostRequest struct {
+	Post struct {
+		Body string `json:"body"`
+	} `json:"post"`
+}
+
+type UpdateCommentRequest struct {
+	Comment struct {
+		Body string `json:"body"`
+	} `json:"comment"`
+}
+
+type CommentResponse struct {
+	Comments *struct {
+		ID     string `json:"id"`
+		PostID string `json:"postId"`
+	} `json:"comments"`
+}
+
 type ErrorResponse struct {
 	Err            string `json:"err"`
 	HTTPStatus     string `json:"-"`
@@ -102,10 +174,11 @@ type PostResponse struct {
 
 type RTNewComment struct {
 	Comment struct {
-		ID     string `json:"id"`
-		Body   string `json:"body"`
-		UserID string `json:"createdBy"`
-		PostID string `json:"postId"`
+		ID        string `json:"id"`
+		Body      string `json:"body"`
+		UserID    string `json:"createdBy"`
+		PostID    string `json:"postId"`
+		CreatedAt string `json:"createdAt"`
 	} `json:"comments"`
 	Users []struct {
 		ID   string `json:"id"`
@@ -113,6 +186,17 @@ type RTNewComment struct {
 	} `json:"users"`
 }
 
+type RTPostDestroy struct {
+	Meta struct {
+		PostID string `json:"postId"`
+	} `json:"meta"`
+}
+
+type RTCommentDestroy struct {
+	PostID    string `json:"postId"`
+	CommentID string `json:"commentId"`
+}
+
 type WhoAmIResponse struct {
 	User struct {
 		Subscribers []struct {
@@ -154,6 +238,18 @@ func (f *PostResponseStaff) UserNameByFeedID(feedID string) (name, typ string) {
 	return
 }
 
+func (f *PostResponseStaff) AttachmentsByIDs(ids []string) (atts []*Attachment) {
+	for _, id := range ids {
+		for _, a := range f.Attachments {
+			if a.ID == id {
+				atts = append(atts, a)
+				break
+			}
+		}
+	}
+	return
+}
+
 func (f *DirectChannelResponse) AllPosts() (posts []*Post) {
 	for _, p := range f.Posts {
 		post := new(Post)
@@ -166,6 +262,9 @@ func (f *DirectChannelResponse) AllPosts() (posts []*Post) {
 				post.Addressees = append(post.Addressees, n)
 			}
 		}
+		post.Attachments = f.AttachmentsByIDs(p.AttachmentIDs)
+		post.CreatedAt, _ = strconv.ParseInt(p.CreatedAt, 10, 64)
+		post.BumpedAt, _ = strconv.ParseInt(p.BumpedAt, 10, 64)
 		posts = append(posts, post)
 	}
 	return
@@ -182,6 +281,15 @@ func (f *OnePostResponse) GetPost() *Post {
 			post.Addressees = append(post.Addressees, n)
 		}
 	}
+	post.Attachments = f.AttachmentsByIDs(f.Post.AttachmentIDs)
+	post.CreatedAt, _ = strconv.ParseInt(f.Post.CreatedAt, 10, 64)
+	post.BumpedAt, _ = strconv.ParseInt(f.Post.BumpedAt, 10, 64)
+	for _, c := range f.Comments {
+		comment := &Comment{ID: c.ID, Body: c.Body, Author: f.UserNameByID(c.UserID)}
+		comment.CreatedAt, _ = strconv.ParseInt(c.CreatedAt, 10, 64)
+		post.Comments = append(post.Comments, comment)
+	}
+	sort.SliceStable(post.Comments, func(i, j int) bool { return post.Comments[i].CreatedAt < post.Comments[j].CreatedAt })
 	return post
 }
 
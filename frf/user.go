@@ -8,6 +8,8 @@ type User struct {
 	Name        string // freefeed username
 	AccessToken string
 	DirectFeed  string
+	Host        string // хост инстанса FreeFeed; пустой для записей, созданных до поддержки других инстансов
+	Invalid     bool   `json:",omitempty"` // сервер отверг токен, нужен новый
 }
 
 func (u *User) Sign(r *http.Request) *http.Request {
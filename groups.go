@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/davidmz/FreefeedDirectBot/frf"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Групповой режим: группа Telegram привязывается к директу с несколькими адресатами.
+// Новые комментарии к нему приходят в группу через realtime-соединение того, кто привязал
+// группу (владельца), а участники, подключившие свои аккаунты FreeFeed, пишут в группу
+// и их сообщения становятся комментариями от их имени.
+
+var GroupsBucket = []byte("Groups")
+
+type groupBinding struct {
+	ChatID  int64
+	PostID  string
+	Host    string   // инстанс FreeFeed
+	Owner   TgUserID // кто привязал группу; уведомления приходят через его соединение
+	Account string   // аккаунт владельца, участвующий в директе
+	Members []string // участники директа: автор и адресаты
+
+	// последний пересланный в группу комментарий: он может прийти и через realtime, и при догоняющей загрузке
+	Forwarded   int64 // время, в миллисекундах
+	LastComment string
+}
+
+func (g *groupBinding) IsMember(name string) bool {
+	for _, m := range g.Members {
+		if m == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ownedBy сообщает, идут ли уведомления для группы через аккаунт account пользователя userID
+func (g *groupBinding) ownedBy(userID TgUserID, account *frf.User) bool {
+	return g.Owner == userID && g.Host == account.Host && g.Account == account.Name
+}
+
+func groupKey(chatID int64) []byte { return []byte(strconv.FormatInt(chatID, 10)) }
+
+func (a *App) LoadGroup(chatID int64) (g *groupBinding) {
+	a.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(GroupsBucket).Get(groupKey(chatID))
+		if data == nil {
+			return nil
+		}
+		g = new(groupBinding)
+		if err := json.Unmarshal(data, g); err != nil {
+			log.Println("Can not decode group binding of", chatID, err)
+			g = nil
+		}
+		return nil
+	})
+	return
+}
+
+func (a *App) SaveGroup(g *groupBinding) {
+	a.db.Update(func(tx *bolt.Tx) error {
+		data, _ := json.Marshal(g)
+		return tx.Bucket(GroupsBucket).Put(groupKey(g.ChatID), data)
+	})
+}
+
+func (a *App) DeleteGroup(chatID int64) {
+	a.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(GroupsBucket).Delete(groupKey(chatID))
+	})
+}
+
+// findGroups возвращает привязки, для которых match возвращает true
+func (a *App) findGroups(match func(g *groupBinding) bool) (groups []*groupBinding) {
+	a.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(GroupsBucket).ForEach(func(k, v []byte) error {
+			g := new(groupBinding)
+			if err := json.Unmarshal(v, g); err != nil {
+				log.Println("Can not decode group binding of", string(k), err)
+				return nil
+			}
+			if match(g) {
+				groups = append(groups, g)
+			}
+			return nil
+		})
+	})
+	return
+}
+
+// unbindGroups отвязывает группы и сообщает им об этом
+func (a *App) unbindGroups(groups []*groupBinding, reason string) {
+	for _, g := range groups {
+		a.DeleteGroup(g.ChatID)
+		a.SendText(g.ChatID, reason+" Группа больше не связана с директом.")
+	}
+}
+
+// UnbindOwnedGroups отвязывает группы, уведомления для которых шли через аккаунт account пользователя userID
+func (a *App) UnbindOwnedGroups(userID TgUserID, account *frf.User) {
+	a.unbindGroups(a.findGroups(func(g *groupBinding) bool {
+		return g.ownedBy(userID, account)
+	}), "Аккаунт "+account.Name+", через который я следил за обсуждением, отключён.")
+}
+
+// ownsGroups сообщает, идут ли через аккаунт account пользователя userID уведомления для каких-нибудь групп
+func (a *App) ownsGroups(userID TgUserID, account *frf.User) bool {
+	return len(a.findGroups(func(g *groupBinding) bool { return g.ownedBy(userID, account) })) > 0
+}
+
+// groupOutKey — отметка о комментарии, отправленном из группы. Он вернётся через realtime,
+// и пересылать его в ту же группу не нужно. ID комментария может стать известен позже,
+// чем придёт событие, поэтому отмечается автор и текст, а отметка живёт недолго:
+// иначе такой же текст того же автора, написанный потом во FreeFeed, в группу бы не попал.
+func groupOutKey(chatID int64, author, body string) string {
+	return "grp:" + strconv.FormatInt(chatID, 10) + ":" + author + ":" + body
+}
+
+const groupOutTTL = time.Minute
+
+// markForwarded отмечает, что comment переслан в группу chatID. Возвращает false,
+// если этот или более поздний комментарий уже пересылали.
+func (a *App) markForwarded(chatID int64, comment *frf.Comment) (isNew bool) {
+	a.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(GroupsBucket)
+		g := new(groupBinding)
+		if data := b.Get(groupKey(chatID)); data == nil || json.Unmarshal(data, g) != nil {
+			return nil
+		}
+		if comment.CreatedAt < g.Forwarded || comment.CreatedAt == g.Forwarded && comment.ID == g.LastComment {
+			return nil
+		}
+		g.Forwarded, g.LastComment = comment.CreatedAt, comment.ID
+		data, _ := json.Marshal(g)
+		isNew = true
+		return b.Put(groupKey(chatID), data)
+	})
+	return
+}
+
+// forwardToGroups пересылает новый комментарий в группы, привязанные к посту postID,
+// если уведомления для них идут через аккаунт account пользователя userID
+func (a *App) forwardToGroups(userID TgUserID, account *frf.User, postID string, comment *frf.Comment) {
+	groups := a.findGroups(func(g *groupBinding) bool {
+		return g.PostID == postID && g.ownedBy(userID, account)
+	})
+	for _, g := range groups {
+		if !a.markForwarded(g.ChatID, comment) {
+			continue
+		}
+		key := groupOutKey(g.ChatID, comment.Author, comment.Body)
+		if _, err := a.cache.Get(key); err == nil {
+			a.cache.Remove(key)
+			continue
+		}
+		a.SendText(g.ChatID, "💬 "+comment.Author+":\n"+comment.Body)
+	}
+}
+
+// HandleGroupMessage обрабатывает сообщение в группе
+func (a *App) HandleGroupMessage(ctx context.Context, msg *tgbotapi.Message) {
+	group := a.LoadGroup(msg.Chat.ID)
+
+	switch cmd := msg.Command(); {
+	case cmd == "bind":
+		a.bindGroup(ctx, msg, group)
+
+	case cmd == "unbind":
+		a.unbindGroup(ctx, msg, group)
+
+	case cmd == "help":
+		a.replyInGroup(msg, GroupHelpMessage)
+
+	case cmd != "":
+		// остальные команды — для личного чата
+
+	case group == nil:
+		// непривязанная группа, разговоры участников нас не касаются
+
+	default:
+		a.postFromGroup(ctx, msg, group)
+	}
+}
+
+func (a *App) bindGroup(ctx context.Context, msg *tgbotapi.Message, group *groupBinding) {
+	if group != nil {
+		a.replyInGroup(msg, "Группа уже связана с директом. Чтобы связать её с другим, сначала используйте /unbind")
+		return
+	}
+	// все, кто в группе, будут читать директ, так что решать это может только её администратор
+	if !a.checkGroupAdmin(msg, "Связать группу с директом может только администратор группы.") {
+		return
+	}
+	state := a.LoadState(TgUserID(msg.From.ID))
+	if !state.IsAuthorized() {
+		a.replyInGroup(msg, "Сначала подключите свой аккаунт FreeFeed в личном чате со мной (/start).")
+		return
+	}
+	shortCode := strings.TrimSpace(msg.CommandArguments())
+	if shortCode == "" {
+		a.replyInGroup(msg, "Укажите номер директа: /bind xxxx (это номер после «№» в конце уведомлений о директе).")
+		return
+	}
+
+	post, err := a.getPost(ctx, state.User, shortCode)
+	if errors.Is(err, frf.ErrNotFound) {
+		a.replyInGroup(msg, "Сообщение не найдено среди директов аккаунта "+state.User.Name+".")
+		return
+	} else if errors.Is(err, context.Canceled) {
+		return
+	} else if err != nil {
+		a.replyInGroup(msg, "Что-то пошло не так: "+errText(err))
+		return
+	}
+	if len(post.Addressees) < 2 {
+		a.replyInGroup(msg, "Это директ для двоих. С группой можно связать только директ с несколькими адресатами.")
+		return
+	}
+
+	// участники директа должны знать, что его читают в группе
+	notice := "Я связал это обсуждение с группой Telegram «" + msg.Chat.Title + "»: " +
+		"новые комментарии к нему будут видны всем её участникам."
+	if _, err := a.api(state.User).CreateComment(ctx, post.ID, notice); errors.Is(err, context.Canceled) {
+		return
+	} else if err != nil {
+		a.replyInGroup(msg, "Не удалось сообщить участникам директа о группе, поэтому она не связана: "+errText(err))
+		return
+	}
+
+	group = &groupBinding{
+		ChatID:  msg.Chat.ID,
+		PostID:  post.ID,
+		Host:    a.hostOf(state.User),
+		Owner:   state.UserID,
+		Account: state.User.Name,
+		Members: append([]string{post.Author}, post.Addressees...),
+	}
+	// пересылаются только комментарии, появившиеся после привязки (и после уведомления о ней)
+	group.Forwarded = maxInt64(post.CreatedAt, post.BumpedAt)
+	if thread, err := a.getThread(ctx, state.User, post.ID); err == nil {
+		for _, c := range thread.Comments {
+			if c.CreatedAt >= group.Forwarded {
+				group.Forwarded, group.LastComment = c.CreatedAt, c.ID
+			}
+		}
+	}
+	a.SaveGroup(group)
+	a.replyInGroup(msg, "Группа связана с директом "+post.Author+" → "+strings.Join(post.Addressees, ", ")+
+		" «"+post.ShortBody()+"», его участники получили об этом комментарий. Новые комментарии к директу будут появляться здесь. "+
+		"Участники директа, подключившие свои аккаунты FreeFeed в личном чате со мной, "+
+		"могут отвечать прямо здесь — их сообщения станут комментариями.")
+}
+
+// checkGroupAdmin проверяет, что автор msg — администратор группы, и если нет, отвечает denied
+func (a *App) checkGroupAdmin(msg *tgbotapi.Message, denied string) bool {
+	member, err := a.bot.GetChatMember(tgbotapi.ChatConfigWithUser{ChatID: msg.Chat.ID, UserID: msg.From.ID})
+	if err != nil {
+		a.replyInGroup(msg, "Не удалось проверить ваши права в группе: "+errText(err))
+		return false
+	}
+	if !member.IsCreator() && !member.IsAdministrator() {
+		a.replyInGroup(msg, denied)
+		return false
+	}
+	return true
+}
+
+func (a *App) unbindGroup(ctx context.Context, msg *tgbotapi.Message, group *groupBinding) {
+	if group == nil {
+		a.replyInGroup(msg, "Группа ни к чему не привязана.")
+		return
+	}
+	if !a.checkGroupAdmin(msg, "Отвязать группу от директа может только администратор группы.") {
+		return
+	}
+	a.DeleteGroup(msg.Chat.ID)
+
+	// о привязке участники директа узнали из комментария, так же сообщаем и об отвязке
+	notice := "Я отвязал это обсуждение от группы Telegram «" + msg.Chat.Title + "»: новые комментарии к нему там больше не видны."
+	account := a.LoadState(group.Owner).Account(group.Host, group.Account)
+	if account == nil {
+		a.replyInGroup(msg, "OK, группа больше не связана с директом. Аккаунт "+group.Account+
+			", через который она была связана, уже не подключён, поэтому участникам директа я об этом не сообщил.")
+		return
+	}
+	if _, err := a.api(account).CreateComment(ctx, group.PostID, notice); errors.Is(err, context.Canceled) {
+		return
+	} else if err != nil {
+		a.replyInGroup(msg, "OK, группа больше не связана с директом, но сообщить об этом его участникам не удалось: "+errText(err))
+		return
+	}
+	a.replyInGroup(msg, "OK, группа больше не связана с директом, его участники получили об этом комментарий.")
+}
+
+// groupAccount возвращает аккаунт пользователя, которым он может писать в директ группы:
+// активный, если он участник директа, иначе любой другой участвующий
+func (a *App) groupAccount(state *State, group *groupBinding) *frf.User {
+	if !state.IsAuthorized() {
+		return nil
+	}
+	fits := func(u *frf.User) bool {
+		return !u.Invalid && a.hostOf(u) == group.Host && group.IsMember(u.Name)
+	}
+	if fits(state.User) {
+		return state.User
+	}
+	for _, u := range state.Accounts {
+		if fits(u) {
+			return u
+		}
+	}
+	return nil
+}
+
+// postFromGroup публикует сообщение участника группы как комментарий от его имени
+func (a *App) postFromGroup(ctx context.Context, msg *tgbotapi.Message, group *groupBinding) {
+	member := a.LoadState(TgUserID(msg.From.ID))
+	account := a.groupAccount(member, group)
+	if account == nil {
+		a.replyInGroup(msg, "Сообщение не отправлено во FreeFeed: писать в это обсуждение могут только участники директа ("+
+			strings.Join(group.Members, ", ")+"), подключившие свои аккаунты в личном чате со мной (/start).")
+		return
+	}
+	if msg.Text == "" {
+		a.replyInGroup(msg, "Сообщение не отправлено во FreeFeed: комментарий может быть только текстовым.")
+		return
+	}
+
+	key := groupOutKey(group.ChatID, account.Name, msg.Text)
+	a.cache.SetWithExpire(key, struct{}{}, groupOutTTL)
+	if _, err := a.api(account).CreateComment(ctx, group.PostID, msg.Text); err != nil {
+		a.cache.Remove(key)
+		if !errors.Is(err, context.Canceled) {
+			a.replyInGroup(msg, "Не удалось отправить комментарий: "+errText(err))
+		}
+	}
+}
+
+func (a *App) replyInGroup(msg *tgbotapi.Message, text string) {
+	m := tgbotapi.NewMessage(msg.Chat.ID, text)
+	m.ReplyToMessageID = msg.MessageID
+	a.outbox <- m
+}
+
+func isGroupChat(chat *tgbotapi.Chat) bool {
+	return chat != nil && (chat.IsGroup() || chat.IsSuperGroup())
+}
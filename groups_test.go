@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/davidmz/FreefeedDirectBot/faketg"
+)
+
+const group = -100
+
+// bindTestGroup привязывает группу к директу bob → alice, carol, который alice видит через realtime
+func bindTestGroup(t *testing.T) (e *testEnv, postID string) {
+	e = newTestEnv(t)
+	e.friends("alice", "bob")
+	e.friends("carol", "bob")
+	post, err := e.frf.SendDirect("bob", "Встречаемся?", "alice", "carol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.login(alice, "alice")
+	e.waitRT(alice, "alice")
+
+	e.bot.MakeAdmin(group, alice)
+	e.bot.SayInGroup(group, alice, "/bind "+shortCode(post.ID))
+	e.run(faketg.Expect(group, "Группа связана с директом bob → alice, carol «Встречаемся?»*"))
+	return e, post.ID
+}
+
+func TestGroupBind(t *testing.T) {
+	e := newTestEnv(t)
+	e.friends("alice", "bob")
+	e.friends("carol", "bob")
+	post, _ := e.frf.SendDirect("bob", "Встречаемся?", "alice", "carol")
+	e.login(alice, "alice")
+
+	// не администратор группы связать её не может
+	e.bot.SayInGroup(group, alice, "/bind "+shortCode(post.ID))
+	e.run(faketg.Expect(group, "Связать группу с директом может только администратор группы."))
+
+	e.bot.MakeAdmin(group, alice)
+	e.bot.SayInGroup(group, alice, "/bind "+shortCode(post.ID))
+	e.run(faketg.Expect(group, "Группа связана с директом*"))
+	// участники директа узнают о группе из комментария
+	if cc := e.frf.Comments(post.ID); len(cc) != 1 || !strings.Contains(cc[0].Body, "«Group 100»") {
+		t.Fatalf("unexpected comments %+v", cc)
+	}
+}
+
+func TestGroupEcho(t *testing.T) {
+	e, postID := bindTestGroup(t)
+
+	// своё сообщение из группы в неё не возвращается, а чужой комментарий приходит
+	e.bot.SayInGroup(group, alice, "В семь")
+	e.waitFor("comment from group", func() bool { return len(e.frf.Comments(postID)) == 2 })
+	if _, err := e.frf.AddComment("bob", postID, "Договорились"); err != nil {
+		t.Fatal(err)
+	}
+	e.run(faketg.Expect(group, "💬 bob:\nДоговорились"))
+}
+
+func TestGroupForwardWhilePaused(t *testing.T) {
+	e, postID := bindTestGroup(t)
+
+	// владелец заблокировал бота, но группа продолжает получать комментарии
+	e.app.PauseUser(alice)
+	if _, err := e.frf.AddComment("carol", postID, "Я буду"); err != nil {
+		t.Fatal(err)
+	}
+	e.run(faketg.Expect(group, "💬 carol:\nЯ буду"))
+}
+
+func TestGroupCatchUp(t *testing.T) {
+	e, postID := bindTestGroup(t)
+	e.app.PauseUser(alice)
+	notices := e.sentTo(alice)
+	account := e.app.LoadState(alice).User
+	// соединение пропало, а пока его не было, появились комментарии
+	e.app.StopRT(alice, account)
+	// первая догоняющая загрузка после подключения только запоминает, докуда дочитано
+	e.waitFor("watermark", func() bool { return e.app.Watermark(alice, account) != 0 })
+	since := e.app.Watermark(alice, account)
+	e.frf.AddComment("bob", postID, "Раз")
+	e.frf.AddComment("carol", postID, "Два")
+
+	e.app.CatchUp(context.Background(), alice, account, since)
+	e.run(
+		faketg.Expect(group, "💬 bob:\nРаз"),
+		faketg.Expect(group, "💬 carol:\nДва"),
+	)
+
+	// повторная догоняющая загрузка ничего не пересылает заново
+	e.app.CatchUp(context.Background(), alice, account, since)
+	e.frf.AddComment("bob", postID, "Три")
+	e.app.CatchUp(context.Background(), alice, account, since)
+	e.run(faketg.Expect(group, "💬 bob:\nТри"))
+	if n := e.sentTo(alice); n != notices {
+		t.Errorf("paused user got %d messages", n-notices)
+	}
+}
+
+func TestGroupUnbind(t *testing.T) {
+	e, postID := bindTestGroup(t)
+
+	e.bot.SayInGroup(group, bob, "/unbind")
+	e.run(faketg.Expect(group, "Отвязать группу от директа может только администратор группы."))
+
+	e.bot.SayInGroup(group, alice, "/unbind")
+	e.run(faketg.Expect(group, "OK, группа больше не связана с директом, его участники получили об этом комментарий."))
+	if cc := e.frf.Comments(postID); len(cc) != 2 || !strings.Contains(cc[1].Body, "отвязал") {
+		t.Fatalf("unexpected comments %+v", cc)
+	}
+	if e.app.LoadGroup(group) != nil {
+		t.Error("group is still bound")
+	}
+}
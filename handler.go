@@ -1,8 +1,9 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"net/http"
 	"regexp"
 	"sort"
 	"strconv"
@@ -14,13 +15,15 @@ import (
 
 var reCmdRE = regexp.MustCompile(`/re_([a-f0-9]{4,})`)
 
-func (a *App) HandleMessage(msg *tgbotapi.Message) {
+func (a *App) HandleMessage(ctx context.Context, msg *tgbotapi.Message) {
 	state := a.LoadState(TgUserID(msg.From.ID))
 	a.ResetState(state) // по умолчанию сбрасываем состояние
 
-	replyToShortCode := ""
+	replyToShortCode, replyToPostID := "", ""
 	if msg.ReplyToMessage != nil {
+		replyToPostID, _, _ = a.PostByMessage(msg.Chat.ID, msg.ReplyToMessage.MessageID)
 		if m := reCmdRE.FindAllStringSubmatch(msg.ReplyToMessage.Text, -1); m != nil {
+			// сообщения, отправленные до появления кнопок
 			replyToShortCode = m[len(m)-1][1]
 		}
 	}
@@ -28,8 +31,11 @@ func (a *App) HandleMessage(msg *tgbotapi.Message) {
 	switch cmd := msg.Command(); {
 
 	case cmd == "cancel":
+		interrupted := a.cancelOperations(state.UserID, ctx)
 		if state.Action != ActNothing {
 			a.SendText(state.UserID, "OK, операция «"+state.ActionTitle()+"» отменена.")
+		} else if interrupted > 0 {
+			a.SendText(state.UserID, "OK, прерываю запрос к FreeFeed.")
 		} else {
 			a.SendText(state.UserID, "Сейчас нечего отменять. Используйте /help чтобы увидеть список команд.")
 		}
@@ -38,187 +44,380 @@ func (a *App) HandleMessage(msg *tgbotapi.Message) {
 		a.SendText(state.UserID, HelpMessage)
 
 	case cmd == "start":
-		if !state.IsAuthorized() {
-			for _, m := range HelloMessages {
+		if state.IsAuthorized() && state.Paused {
+			a.ResumeUser(state)
+			a.SendText(state.UserID, "С возвращением, "+state.User.Name+"! Снова присылаю уведомления о директах.")
+		} else if !state.IsAuthorized() {
+			host, ok := a.parseHost(msg.CommandArguments())
+			if !ok {
+				a.SendText(state.UserID, "Не похоже на адрес сайта. Укажите адрес инстанса FreeFeed, например: /start candy.freefeed.net")
+				break
+			}
+			for _, m := range HelloMessages(host) {
 				a.SendText(state.UserID, m)
 			}
-			a.SaveState(state.Clone(ActNewToken))
+			st := state.Clone(ActNewToken)
+			st.Host = host
+			a.SaveState(st)
 		} else {
 			a.SendText(state.UserID,
 				"Мы с вами уже знакомы, "+state.User.Name+". "+
-					"Если вы хотите чтобы я вас забыл, используйте команду /logout",
+					"Если вы хотите подключить ещё один аккаунт FreeFeed, используйте команду /add, "+
+					"а если хотите чтобы я вас забыл — команду /logout",
 			)
 		}
 
+	case cmd == "add" && state.IsAuthorized():
+		host, ok := a.parseHost(msg.CommandArguments())
+		if !ok {
+			a.SendText(state.UserID, "Не похоже на адрес сайта. Укажите адрес инстанса FreeFeed, например: /add candy.freefeed.net")
+			break
+		}
+		a.SendText(state.UserID, TokenMessage(host))
+		a.SendText(state.UserID, "Пожалуйста, введите access token аккаунта, который вы хотите подключить (/cancel — отмена):")
+		st := state.Clone(ActNewToken)
+		st.Host = host
+		a.SaveState(st)
+
 		// возврат из команды /start
 	case cmd == "" && state.Action == ActNewToken && msg.Text != "":
 		a.SendText(state.UserID, "Спасибо, проверяю ваш токен…")
-		u, err := a.testToken(msg.Text)
-		if er, ok := err.(*frf.ErrorResponse); ok && er.HTTPStatusCode == http.StatusUnauthorized {
+		host := state.Host
+		if host == "" {
+			host = a.apiHost
+		}
+		u, err := a.testToken(ctx, host, msg.Text)
+		if errors.Is(err, context.Canceled) {
+			// пользователь отменил проверку, состояние уже сброшено
+		} else if errors.Is(err, frf.ErrUnauthorized) {
 			a.SaveState(state)
 			a.SendText(state.UserID, "Похоже, вы указали неправильный токен. Попробуйте ещё раз?")
 		} else if err != nil {
 			a.SaveState(state)
-			a.SendText(state.UserID, "Что-то пошло не так: "+err.Error()+"\nПопробуйте ещё раз?")
+			a.SendError(state.UserID, "Что-то пошло не так: %s\nПопробуйте ещё раз?", err)
 		} else {
-			state.User = u
+			isFirst := !state.IsAuthorized()
+			state.AddAccount(u)
 			a.ResetState(state) // сохраняем с новым пользователем
-			a.SendText(state.UserID,
-				"Рад знакомству, "+state.User.Name+"!\n"+
-					"Теперь, когда появятся новые директы или комментарии к ним, я вам об этом сообщу. "+
-					"Если хотите узнать больше о моих возможностях, используйте коменду /help")
-			a.StartRT(state)
+			if isFirst {
+				a.SendText(state.UserID,
+					"Рад знакомству, "+state.User.Name+"!\n"+
+						"Теперь, когда появятся новые директы или комментарии к ним, я вам об этом сообщу. "+
+						"Если хотите узнать больше о моих возможностях, используйте коменду /help")
+			} else {
+				a.SendText(state.UserID,
+					"Аккаунт "+state.User.Name+" подключён и сейчас активен. "+
+						"Список ваших аккаунтов: /accounts")
+			}
+			a.StartRT(state.UserID, state.User)
 		}
 
 	case cmd == "logout" && state.IsAuthorized():
-		a.StopRT(state)
+		a.StopRT(state.UserID, state.User)
+		a.ForgetWatermark(state.UserID, state.User)
+		a.UnbindOwnedGroups(state.UserID, state.User)
 		st := state.Clone(ActNothing)
-		st.User = nil
+		st.RemoveAccount(state.User)
 		a.SaveState(st)
-		a.SendText(state.UserID, "Всё, я вас забыл и стёр все данные о вас. "+
-			"Если захотите вернуться, используйте команду /start")
+		if st.IsAuthorized() {
+			a.SendText(state.UserID, "Аккаунт "+state.User.Name+" отключён, я стёр его токен. "+
+				"Теперь активен аккаунт "+st.User.Name+".")
+		} else {
+			a.SendText(state.UserID, "Всё, я вас забыл и стёр все данные о вас. "+
+				"Если захотите вернуться, используйте команду /start")
+		}
+
+	case cmd == "accounts" && state.IsAuthorized():
+		lines := []string{"Ваши аккаунты FreeFeed:"}
+		health := a.RTHealth(state.UserID)
+		for _, u := range state.Accounts {
+			where := ""
+			if a.hostOf(u) != a.apiHost {
+				where = " на " + u.Host
+			}
+			if u.Invalid {
+				where += " — " + rtStatusTitles[RTUnauthorized]
+			} else if h, ok := health[rtKey{state.UserID, u.Host, u.Name}]; ok && h.Status != RTConnected {
+				where += " — " + rtStatusTitles[h.Status]
+			}
+			if state.IsActive(u) {
+				lines = append(lines, "    "+u.Name+where+" (активный)")
+			} else if _, ambiguous := state.FindAccount(u.Name, ""); ambiguous {
+				lines = append(lines, "    /use_"+u.Name+" "+u.Host+where)
+			} else {
+				lines = append(lines, "    /use_"+u.Name+where)
+			}
+		}
+		lines = append(lines, "Директы и комментарии пишутся от имени активного аккаунта. "+
+			"Подключить ещё один аккаунт: /add, отключить активный: /logout")
+		a.SendText(state.UserID, strings.Join(lines, "\n"))
+
+	case (cmd == "use" || strings.HasPrefix(cmd, "use_")) && state.IsAuthorized():
+		name := strings.TrimPrefix(strings.TrimPrefix(cmd, "use"), "_")
+		args := strings.Fields(strings.ToLower(msg.CommandArguments()))
+		if name == "" && len(args) > 0 {
+			name, args = args[0], args[1:]
+		}
+		host := ""
+		if len(args) > 0 {
+			host = args[0]
+		}
+		u, ambiguous := state.FindAccount(name, host)
+		if ambiguous {
+			a.SendText(state.UserID, "Аккаунт «"+name+"» подключён у вас на нескольких инстансах FreeFeed. "+
+				"Укажите нужный, например: /use_"+name+" freefeed.net")
+			break
+		}
+		if u == nil {
+			a.SendText(state.UserID, "У вас нет подключённого аккаунта «"+name+"». Список ваших аккаунтов: /accounts")
+			break
+		}
+		state.UseAccount(u.Host, u.Name)
+		a.SaveState(state.Clone(ActNothing))
+		a.SendText(state.UserID, "OK, теперь активен аккаунт "+name+".")
 
 	case cmd == "contacts" && state.IsAuthorized():
-		contacts, err := a.getContacts(state.User)
+		contacts, err := a.getContacts(ctx, state.User)
 		if err != nil {
-			a.SendText(state.UserID, "Что-то пошло не так: "+err.Error())
+			a.SendError(state.UserID, "Что-то пошло не так: %s", err)
 		} else if len(contacts) == 0 {
 			a.SendText(state.UserID, "Похоже, у вас нет взаимных друзей. Вы никому не можете написать директ.")
 		} else {
-			lines := []string{}
-			lines = append(lines, "Ваши взаимные друзья:")
+			var rows [][]tgbotapi.InlineKeyboardButton
 			for _, c := range contacts {
-				lines = append(lines, "    /to_"+c)
+				rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData(c, cbTo+c)))
 			}
-			lines = append(lines, "Вы можете отправить директ нескольким получателям, кликнув последовательно по их именам.")
-			a.SendText(state.UserID, strings.Join(lines, "\n"))
+			m := tgbotapi.NewMessage(state.UserID, "Ваши взаимные друзья:\n"+
+				"Вы можете отправить директ нескольким получателям, нажав последовательно на их имена.")
+			m.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+			a.outbox <- m
 		}
 
 	case strings.HasPrefix(cmd, "to_") && state.IsAuthorized():
-		name := strings.TrimPrefix(cmd, "to_")
-		if state.Action != ActComposePost {
-			state = state.Clone(ActComposePost)
-		}
-
-		p := sort.SearchStrings(state.Addressees, name)
-		if p == len(state.Addressees) || state.Addressees[p] != name {
-			// insert into position p
-			state.Addressees = append(state.Addressees, "")
-			copy(state.Addressees[p+1:], state.Addressees[p:])
-			state.Addressees[p] = name
-		}
-		a.SaveState(state)
-		a.SendText(state.UserID, "OK, ваше сообщение для "+humanList(state.Addressees, state.User.Name, "вас")+" (/cancel — отмена)	:")
+		a.addAddressee(state, strings.TrimPrefix(cmd, "to_"))
 
 		// возврат из команды /to*
-	case cmd == "" && state.Action == ActComposePost && msg.Text != "":
-		if msg.Text == "" {
+	case cmd == "" && state.Action == ActComposePost:
+		text := msg.Text
+		if hasAttachments(msg) {
+			text = msg.Caption
+		}
+		if text == "" && !hasAttachments(msg) {
 			a.SaveState(state)
-			a.SendText(state.UserID, "Извините, сообщение может быть только текстовым. Попробуйте ещё раз (/cancel — отмена)?")
+			a.SendText(state.UserID, "Извините, сообщение может быть только текстом, фото или файлом. Попробуйте ещё раз (/cancel — отмена)?")
 			break
 		}
-		postID, err := a.sendDirect(state.User, state.Addressees, msg.Text)
+		attachments, err := a.uploadMsgAttachments(ctx, state.User, msg)
+		if errors.Is(err, context.Canceled) {
+			break
+		} else if err != nil {
+			a.SaveState(state)
+			a.SendError(state.UserID, "Не удалось загрузить файл: %s\nПопробуйте ещё раз (/cancel — отмена)?", err)
+			break
+		}
+		if text == "" {
+			text = attachmentsPlaceholder(msg)
+		}
+		postID, err := a.sendDirect(ctx, state.User, state.Addressees, text, attachments)
 		if err != nil {
-			a.SendText(state.UserID, "Не удалось отправить сообщение. "+err.Error())
+			a.SendError(state.UserID, "Не удалось отправить сообщение: %s", err)
 		} else {
-			shortCode := postID[:4]
-			m := tgbotapi.NewMessage(state.UserID,
-				"Сообщение отправлено!\n"+
-					strings.Repeat("\u2500", 10)+"\n"+
-					"Ответить: /re_"+shortCode+" или ответить (Reply) на это сообщение\n"+
-					"Открыть: https://"+a.apiHost+"/"+state.User.Name+"/"+postID+"\n",
-			)
-			m.DisableWebPagePreview = true
-			a.outbox <- m
+			item := a.newSentItem(state.User, postID, "")
+			a.rememberSent(msg.Chat.ID, msg.MessageID, item)
+			a.SendSentConfirmation(state.UserID, state.User, "Сообщение отправлено!", state.User.Name, item)
 		}
 
 	case strings.HasPrefix(cmd, "re_") && state.IsAuthorized():
 		shortCode := strings.TrimPrefix(cmd, "re_")
-		post, err := a.getPost(state.User, shortCode)
-		if err == ErrNotFound {
+		post, err := a.getPost(ctx, state.User, shortCode)
+		if errors.Is(err, frf.ErrNotFound) {
 			a.SendText(state.UserID, "Сообщение не найдено.")
 		} else if err != nil {
-			a.SendText(state.UserID, "Что-то пошло не так: "+err.Error())
+			a.SendError(state.UserID, "Что-то пошло не так: %s", err)
 		} else {
-			state = state.Clone(ActAddComment)
-			state.PostID = post.ID
-			state.PostAuthor = post.Author
-			a.SaveState(state)
-			a.SendText(state.UserID, "OK, ваш комментарий к сообщению "+post.Author+" «"+post.ShortBody()+"» (/cancel — отмена):")
+			a.startComment(state, post)
 		}
 
 	case cmd == "" && state.Action == ActAddComment:
 		if msg.Text == "" {
 			a.SaveState(state)
-			a.SendText(state.UserID, "Извините, комментарий может быть только текстовым. Попробуйте ещё раз (/cancel — отмена)?")
+			a.SendText(state.UserID, "Извините, комментарий может быть только текстовым: FreeFeed не поддерживает файлы в комментариях. "+
+				"Попробуйте ещё раз (/cancel — отмена)?")
+			break
+		}
+		a.addComment(ctx, state, state.PostAuthor, state.PostID, msg)
+
+	case (cmd == "thread" || strings.HasPrefix(cmd, "thread_")) && state.IsAuthorized():
+		shortCode := strings.TrimPrefix(strings.TrimPrefix(cmd, "thread"), "_")
+		if shortCode == "" && replyToPostID != "" {
+			a.switchToMessageAccount(state, msg.Chat.ID, msg.ReplyToMessage.MessageID)
+			a.SendThread(ctx, state, replyToPostID)
+			break
+		}
+		if shortCode == "" {
+			shortCode = replyToShortCode
+		}
+		if shortCode == "" {
+			a.SendText(state.UserID, "Используйте /thread как ответ (Reply) на сообщение о директе или укажите его номер: /thread_xxxx")
+			break
+		}
+		post, err := a.getPost(ctx, state.User, shortCode)
+		if errors.Is(err, frf.ErrNotFound) {
+			a.SendText(state.UserID, "Сообщение не найдено.")
+		} else if err != nil {
+			a.SendError(state.UserID, "Что-то пошло не так: %s", err)
+		} else {
+			a.SendThread(ctx, state, post.ID)
+		}
+
+	case (cmd == "delete" || strings.HasPrefix(cmd, "delete_")) && state.IsAuthorized():
+		shortCode := strings.TrimPrefix(strings.TrimPrefix(cmd, "delete"), "_")
+		if shortCode == "" {
+			shortCode = strings.TrimSpace(msg.CommandArguments())
+		}
+
+		var item *sentItem
+		if shortCode != "" {
+			post, err := a.getPost(ctx, state.User, shortCode)
+			if errors.Is(err, frf.ErrNotFound) {
+				a.SendText(state.UserID, "Сообщение не найдено.")
+				break
+			} else if err != nil {
+				a.SendError(state.UserID, "Что-то пошло не так: %s", err)
+				break
+			}
+			item = a.newSentItem(state.User, post.ID, "")
+		} else if msg.ReplyToMessage != nil {
+			item = a.sentByMessage(msg.Chat.ID, msg.ReplyToMessage.MessageID)
+		}
+		if item == nil {
+			a.SendText(state.UserID, "Используйте /delete как ответ (Reply) на ваше сообщение или на моё подтверждение его отправки, "+
+				"либо укажите номер директа: /delete_xxxx")
+			break
+		}
+
+		account := state.sentAccount(item)
+		if account == nil {
+			a.SendText(state.UserID, "Это сообщение отправлено от имени аккаунта "+item.Account+", который уже не подключён.")
 			break
 		}
-		req := new(frf.NewCommentRequest)
-		req.Comment.Body = msg.Text
-		req.Comment.PostID = state.PostID
-		err := a.SendRequest(state.User, "POST", "/v1/comments", req, nil)
+		post, err := a.getPostByID(ctx, account, item.PostID)
 		if err != nil {
-			a.SendText(state.UserID, "Что-то пошло не так: "+err.Error())
+			a.SendError(state.UserID, "Что-то пошло не так: %s", err)
+			break
+		}
+
+		st := state.Clone(ActConfirmDelete)
+		st.PostID = item.PostID
+		st.PostAuthor = post.Author
+		st.CommentID = item.CommentID
+		st.AccountName, st.Host = account.Name, a.hostOf(account)
+		a.SaveState(st)
+		if item.IsComment() {
+			a.SendText(state.UserID, "Удалить ваш комментарий к сообщению "+post.Author+" «"+post.ShortBody()+"»? "+
+				"Напишите «да» для подтверждения (/cancel — отмена).")
 		} else {
-			a.SendText(state.UserID, "Комментарий отправлен!\n"+
-				strings.Repeat("\u2500", 10)+"\n"+
-				"Ответить: /re_"+state.PostID[:4]+" или ответить (Reply) на это сообщение\n"+
-				"Открыть: https://"+a.apiHost+"/"+state.PostAuthor+"/"+state.PostID+"\n",
-			)
+			a.SendText(state.UserID, "Удалить сообщение "+post.Author+" «"+post.ShortBody()+"» вместе со всеми комментариями? "+
+				"Напишите «да» для подтверждения (/cancel — отмена).")
+		}
+
+		// возврат из команды /delete
+	case cmd == "" && state.Action == ActConfirmDelete:
+		if strings.ToLower(strings.TrimSpace(msg.Text)) != "да" {
+			a.SendText(state.UserID, "OK, ничего не удаляю.")
+			break
+		}
+		account := state.User // состояние сохранено до того, как в нём появился аккаунт
+		if state.AccountName != "" {
+			account = state.Account(state.Host, state.AccountName)
+		}
+		if account == nil {
+			a.SendText(state.UserID, "Аккаунт "+state.AccountName+" уже не подключён, ничего не удаляю.")
+			break
+		}
+		var err error
+		if state.CommentID != "" {
+			err = a.api(account).DeleteComment(ctx, state.CommentID)
+		} else {
+			err = a.api(account).DeletePost(ctx, state.PostID)
+		}
+		if err != nil {
+			a.SendError(state.UserID, "Не удалось удалить: %s", err)
+		} else if state.CommentID != "" {
+			a.SendText(state.UserID, "Комментарий удалён.")
+		} else {
+			a.SendText(state.UserID, "Сообщение удалено.")
 		}
 
-	case cmd == "" && replyToShortCode != "" && state.IsAuthorized():
-		post, err := a.getPost(state.User, replyToShortCode)
-		if err == ErrNotFound {
+	case cmd == "" && (replyToPostID != "" || replyToShortCode != "") && state.IsAuthorized():
+		a.switchToMessageAccount(state, msg.Chat.ID, msg.ReplyToMessage.MessageID)
+		var (
+			post *frf.Post
+			err  error
+		)
+		if replyToPostID != "" {
+			post, err = a.getPostByID(ctx, state.User, replyToPostID)
+		} else {
+			post, err = a.getPost(ctx, state.User, replyToShortCode)
+		}
+		if errors.Is(err, frf.ErrNotFound) {
 			a.SendText(state.UserID, "Сообщение не найдено.")
 		} else if err != nil {
-			a.SendText(state.UserID, "Что-то пошло не так: "+err.Error())
+			a.SendError(state.UserID, "Что-то пошло не так: %s", err)
 		} else {
 			if msg.Text == "" {
 				a.SendText(state.UserID, "Извините, комментарий может быть только текстовым. Попробуйте ещё раз?")
 				break
 			}
-			req := new(frf.NewCommentRequest)
-			req.Comment.Body = msg.Text
-			req.Comment.PostID = post.ID
-			err := a.SendRequest(state.User, "POST", "/v1/comments", req, nil)
-			if err != nil {
-				a.SendText(state.UserID, "Что-то пошло не так: "+err.Error())
-			} else {
-				a.SendText(state.UserID, "Комментарий отправлен!\n"+
-					strings.Repeat("\u2500", 10)+"\n"+
-					"Ответить: /re_"+post.ID[:4]+" или ответить (Reply) на это сообщение\n"+
-					"Открыть: https://"+a.apiHost+"/"+post.Author+"/"+post.ID+"\n",
-				)
-			}
+			a.addComment(ctx, state, post.Author, post.ID, msg)
 		}
 
 	case cmd == "list" && state.IsAuthorized():
-		cnt, _ := strconv.Atoi(strings.TrimSpace(msg.CommandArguments()))
-		if cnt == 0 {
+		args := strings.Fields(msg.CommandArguments())
+		offset := 0
+		if len(args) > 0 && args[0] == "more" {
+			offset = state.ListOffset
+			args = args[1:]
+		}
+		cnt := 0
+		if len(args) > 0 {
+			cnt, _ = strconv.Atoi(args[0])
+		}
+		if cnt <= 0 {
 			cnt = 5
 		}
-		posts, err := a.getAllPosts(state.User)
+		pager := a.directsPager(ctx, state.User, offset)
+		posts, err := pager.Take(cnt)
 		if err != nil {
-			a.SendText(state.UserID, "Что-то пошло не так: "+err.Error())
+			a.SendError(state.UserID, "Что-то пошло не так: %s", err)
+		} else if len(posts) == 0 && offset > 0 {
+			a.SendText(state.UserID, "Больше директ-сообщений нет.")
 		} else if len(posts) == 0 {
 			a.SendText(state.UserID, "Похоже, у вас нет директ-сообщений.")
 		} else {
-			if len(posts) > cnt {
-				posts = posts[:cnt]
+			st := state.Clone(ActNothing)
+			st.ListOffset = pager.Offset
+			a.SaveState(st)
+
+			if offset > 0 {
+				a.SendText(state.UserID, fmt.Sprintf("Более ранние директ-сообщения (%d):", len(posts)))
+			} else {
+				a.SendText(state.UserID, fmt.Sprintf("Ваши директ-сообщения (%d):", len(posts)))
 			}
-			a.SendText(state.UserID, fmt.Sprintf("Ваши директ-сообщения (%d):", len(posts)))
 			for i := range posts {
 				p := posts[len(posts)-i-1]
-				a.SendText(state.UserID,
-					fmt.Sprintf("%d/%d", i+1, len(posts))+
-						" ✉ "+humanName(p.Author, state.User.Name, "вы")+" \u2192 "+humanList(p.Addressees, state.User.Name, "вам")+":\n"+
-						strings.Repeat("\u2500", 10)+"\n"+
-						p.Body+"\n"+
-						strings.Repeat("\u2500", 10)+"\n"+
-						"Ответить: /re_"+p.ID[:4]+" или ответить (Reply) на это сообщение\n"+
-						"Открыть: https://"+a.apiHost+"/"+p.Author+"/"+p.ID+"\n",
-				)
+				a.SendNotice(state.UserID, &notice{
+					PostID: p.ID,
+					Header: fmt.Sprintf("%d/%d", i+1, len(posts)) +
+						" ✉ " + humanName(p.Author, state.User.Name, "вы") + " \u2192 " + humanList(p.Addressees, state.User.Name, "вам") + ":",
+					Author:  p.Author,
+					Account: state.User.Name,
+					Host:    a.hostOf(state.User),
+				}, p.Body)
+				a.SendAttachments(state.UserID, p.Attachments)
+			}
+			if !pager.Done {
+				a.SendText(state.UserID, "Показать более ранние: /list more")
 			}
 		}
 
@@ -249,6 +448,95 @@ func humanList(names []string, yourName string, yourTitle string) (out string) {
 	return
 }
 
+// addAddressee добавляет получателя к создаваемому директу
+func (a *App) addAddressee(state *State, name string) {
+	if state.Action != ActComposePost {
+		state = state.Clone(ActComposePost)
+	}
+
+	p := sort.SearchStrings(state.Addressees, name)
+	if p == len(state.Addressees) || state.Addressees[p] != name {
+		// insert into position p
+		state.Addressees = append(state.Addressees, "")
+		copy(state.Addressees[p+1:], state.Addressees[p:])
+		state.Addressees[p] = name
+	}
+	a.SaveState(state)
+	a.SendText(state.UserID, "OK, ваше сообщение для "+humanList(state.Addressees, state.User.Name, "вас")+" (/cancel — отмена):")
+}
+
+// startComment переводит пользователя в режим комментирования поста
+func (a *App) startComment(state *State, post *frf.Post) {
+	state = state.Clone(ActAddComment)
+	state.PostID = post.ID
+	state.PostAuthor = post.Author
+	a.SaveState(state)
+	a.SendText(state.UserID, "OK, ваш комментарий к сообщению "+post.Author+" «"+post.ShortBody()+"» (/cancel — отмена):")
+}
+
+func (a *App) addComment(ctx context.Context, state *State, postAuthor, postID string, msg *tgbotapi.Message) {
+	commentID, err := a.api(state.User).CreateComment(ctx, postID, msg.Text)
+	if err != nil {
+		a.SendError(state.UserID, "Что-то пошло не так: %s", err)
+	} else if commentID != "" {
+		item := a.newSentItem(state.User, postID, commentID)
+		a.rememberSent(msg.Chat.ID, msg.MessageID, item)
+		a.SendSentConfirmation(state.UserID, state.User, "Комментарий отправлен!", postAuthor, item)
+	} else {
+		a.SendPost(state.UserID, state.User, "Комментарий отправлен!", postAuthor, postID)
+	}
+}
+
+// HandleEditedMessage передаёт во FreeFeed изменения сообщения, из которого был создан пост или комментарий
+func (a *App) HandleEditedMessage(ctx context.Context, msg *tgbotapi.Message) {
+	state := a.LoadState(TgUserID(msg.From.ID))
+	if !state.IsAuthorized() {
+		return
+	}
+
+	item := a.sentByMessage(msg.Chat.ID, msg.MessageID)
+	if item == nil {
+		// это сообщение ничего не создавало во FreeFeed
+		return
+	}
+
+	text := msg.Text
+	if hasAttachments(msg) {
+		text = msg.Caption
+	}
+	if text == "" {
+		return
+	}
+
+	account := state.sentAccount(item)
+	if account == nil {
+		a.SendText(state.UserID, "Не могу изменить сообщение во FreeFeed: аккаунт "+item.Account+" уже не подключён.")
+		return
+	}
+	var err error
+	if item.IsComment() {
+		err = a.api(account).UpdateComment(ctx, item.CommentID, text)
+	} else {
+		err = a.api(account).UpdatePost(ctx, item.PostID, text)
+	}
+
+	if err != nil {
+		a.SendError(state.UserID, "Не удалось изменить сообщение во FreeFeed: %s", err)
+	} else if item.IsComment() {
+		a.SendText(state.UserID, "Комментарий изменён.")
+	} else {
+		a.SendText(state.UserID, "Сообщение изменено.")
+	}
+}
+
+// attachmentsPlaceholder — текст поста, если к файлу не приложена подпись
+func attachmentsPlaceholder(msg *tgbotapi.Message) string {
+	if msg.Document != nil && msg.Document.FileName != "" {
+		return msg.Document.FileName
+	}
+	return "📎"
+}
+
 func humanName(name string, yourName string, yourTitle string) string {
 	if name == yourName {
 		return yourTitle
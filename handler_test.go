@@ -0,0 +1,816 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bluele/gcache"
+	"github.com/boltdb/bolt"
+	"github.com/davidmz/FreefeedDirectBot/fakefrf"
+	"github.com/davidmz/FreefeedDirectBot/faketg"
+	"github.com/davidmz/FreefeedDirectBot/frf"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const stepTimeout = 5 * time.Second
+
+// testEnv — бот, работающий с поддельными Telegram и FreeFeed
+type testEnv struct {
+	t     *testing.T
+	app   *App
+	bot   *faketg.Bot
+	frf   *fakefrf.Server
+	queue *Delivery
+	users map[string]bool
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+
+	db := testDB(t)
+	srv := fakefrf.New()
+	srv.Start()
+	bot := faketg.New()
+
+	app := &App{
+		db:         db,
+		bot:        bot,
+		apiHost:    srv.Host(),
+		apiScheme:  "http",
+		apiTimeout: stepTimeout,
+		outbox:     make(chan tgbotapi.Chattable),
+		rts:        make(map[rtKey]*Realtime),
+		conns:      make(map[string]*Realtime),
+		dialSem:    make(chan struct{}, maxConcurrentDials),
+		cache:      gcache.New(1000).ARC().Build(),
+		ignored:    make(map[string]int),
+	}
+	delivery := NewDelivery(db, bot, app.OnSent, func(chatID int64) { app.PauseUser(TgUserID(chatID)) })
+	go delivery.Run()
+
+	ctx, stop := context.WithCancel(context.Background())
+	served := make(chan struct{})
+	go func() {
+		app.Serve(ctx, GetUpdatesChan(bot, 1), delivery)
+		close(served)
+	}()
+
+	t.Cleanup(func() {
+		stop()
+		<-served
+		app.rtLk.Lock()
+		for _, r := range app.conns {
+			r.Close()
+		}
+		app.rtLk.Unlock()
+		srv.Close()
+	})
+	return &testEnv{t: t, app: app, bot: bot, frf: srv, queue: delivery, users: make(map[string]bool)}
+}
+
+// testDB создаёт временную базу со всеми бакетами
+func testDB(t *testing.T) *bolt.DB {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "frfbot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := bolt.Open(filepath.Join(dir, "test.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		os.RemoveAll(dir)
+	})
+	if err := db.Update(createBuckets); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// run проигрывает сценарий и останавливает тест при первом расхождении
+func (e *testEnv) run(steps ...faketg.Step) {
+	e.t.Helper()
+	if err := e.bot.Run(steps, stepTimeout); err != nil {
+		e.t.Fatal(err)
+	}
+}
+
+// login подключает пользователю userID аккаунт FreeFeed name (заводя его на сервере)
+func (e *testEnv) login(userID int64, name string) {
+	e.t.Helper()
+	e.user(name)
+	e.run(
+		faketg.Say(userID, "/start"),
+		faketg.Expect(userID, "Привет, я FreeFeed Direct bot!*"),
+		faketg.Expect(userID, TokenMessage(e.app.apiHost)),
+		faketg.Expect(userID, "Я обещаю*"),
+		faketg.Expect(userID, "Пожалуйста, введите ваш access token:"),
+		e.action(userID, ActNewToken),
+		faketg.Say(userID, "token-"+name),
+		faketg.Expect(userID, "Спасибо, проверяю ваш токен…"),
+		faketg.Expect(userID, "Рад знакомству, "+name+"!*"),
+		e.loggedIn(userID, name),
+	)
+}
+
+// state — шаг сценария: дождаться, пока состояние пользователя не станет таким, как описано
+func (e *testEnv) state(userID int64, what string, cond func(*State) bool) faketg.Step {
+	return faketg.Wait(what, func() bool { return cond(e.app.LoadState(TgUserID(userID))) })
+}
+
+// action — шаг сценария: бот ждёт от пользователя действия act
+func (e *testEnv) action(userID int64, act Action) faketg.Step {
+	return e.state(userID, "action «"+string(act)+"»", func(s *State) bool { return s.Action == act })
+}
+
+// loggedIn — шаг сценария: у пользователя активен аккаунт name
+func (e *testEnv) loggedIn(userID int64, name string) faketg.Step {
+	return e.state(userID, "account "+name, func(s *State) bool {
+		return s.Action == ActNothing && s.User != nil && s.User.Name == name
+	})
+}
+
+// user заводит пользователя FreeFeed, если его ещё нет
+func (e *testEnv) user(name string) {
+	if !e.users[name] {
+		e.frf.AddUser(name)
+		e.users[name] = true
+	}
+}
+
+// friends заводит пользователей и делает их взаимными друзьями
+func (e *testEnv) friends(name1, name2 string) {
+	e.user(name1)
+	e.user(name2)
+	e.frf.Befriend(name1, name2)
+}
+
+// lastSent возвращает последнее сообщение бота в чате chatID
+func (e *testEnv) lastSent(chatID int64) *faketg.Sent {
+	e.t.Helper()
+	sent := e.bot.Sent()
+	for i := len(sent) - 1; i >= 0; i-- {
+		if sent[i].ChatID == chatID {
+			return sent[i]
+		}
+	}
+	e.t.Fatalf("no messages in chat %d", chatID)
+	return nil
+}
+
+// replyToLast отвечает (Reply) на последнее сообщение бота о посте
+func (e *testEnv) replyToLast(userID int64, text string) {
+	e.t.Helper()
+	e.replyTo(userID, e.lastSent(userID).MessageID, text)
+}
+
+// replyTo отвечает на сообщение бота о посте, дождавшись, пока бот его запомнит:
+// OnSent вызывается уже после того, как сообщение отправлено
+func (e *testEnv) replyTo(userID int64, msgID int, text string) {
+	e.t.Helper()
+	e.waitFor("message is about a post", func() bool {
+		postID, _, _ := e.app.PostByMessage(userID, msgID)
+		return postID != ""
+	})
+	e.bot.Reply(userID, msgID, text)
+}
+
+// waitFor ждёт, пока cond не станет истинным
+func (e *testEnv) waitFor(what string, cond func() bool) {
+	e.t.Helper()
+	for deadline := time.Now().Add(stepTimeout); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			e.t.Fatal("timed out waiting for: " + what)
+		}
+	}
+}
+
+// answered ждёт ответа бота text на нажатие кнопки
+func (e *testEnv) answered(text string) {
+	e.t.Helper()
+	e.waitFor("callback answer "+text, func() bool {
+		for _, a := range e.bot.Answers() {
+			if a.Text == text {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// sentTo возвращает число сообщений бота в чате chatID
+func (e *testEnv) sentTo(chatID int64) (n int) {
+	for _, s := range e.bot.Sent() {
+		if s.ChatID == chatID {
+			n++
+		}
+	}
+	return
+}
+
+func (e *testEnv) postByBody(body string) *fakefrf.Post {
+	e.t.Helper()
+	for _, p := range e.frf.Posts() {
+		if p.Body == body {
+			return p
+		}
+	}
+	e.t.Fatalf("no post %q on the server", body)
+	return nil
+}
+
+const alice, bob = 1001, 1002
+
+func TestUnauthorized(t *testing.T) {
+	e := newTestEnv(t)
+	e.run(
+		faketg.Say(alice, "привет"),
+		faketg.Expect(alice, "К сожалению, я мало что могу сделать, не зная ваш токен.*"),
+		faketg.Say(alice, "/help"),
+		faketg.Expect(alice, HelpMessage),
+		faketg.Say(alice, "/cancel"),
+		faketg.Expect(alice, "Сейчас нечего отменять.*"),
+	)
+}
+
+func TestStartWithBadToken(t *testing.T) {
+	e := newTestEnv(t)
+	e.user("alice")
+	e.run(
+		faketg.Say(alice, "/start"),
+		faketg.Expect(alice, "Привет, я FreeFeed Direct bot!*"),
+		faketg.Expect(alice, TokenMessage(e.app.apiHost)),
+		faketg.Expect(alice, "Я обещаю*"),
+		faketg.Expect(alice, "Пожалуйста, введите ваш access token:"),
+		e.action(alice, ActNewToken),
+		faketg.Say(alice, "wrong-token"),
+		faketg.Expect(alice, "Спасибо, проверяю ваш токен…"),
+		faketg.Expect(alice, "Похоже, вы указали неправильный токен. Попробуйте ещё раз?"),
+		e.action(alice, ActNewToken),
+		faketg.Say(alice, "token-alice"),
+		faketg.Expect(alice, "Спасибо, проверяю ваш токен…"),
+		faketg.Expect(alice, "Рад знакомству, alice!*"),
+		e.loggedIn(alice, "alice"),
+		faketg.Say(alice, "/start"),
+		faketg.Expect(alice, "Мы с вами уже знакомы, alice.*"),
+	)
+
+	// пользователь, заблокировавший бота, возвращается через /start
+	e.app.PauseUser(alice)
+	e.run(
+		faketg.Say(alice, "/start"),
+		faketg.Expect(alice, "С возвращением, alice!*"),
+	)
+	if e.app.LoadState(alice).Paused {
+		t.Error("user is still paused")
+	}
+}
+
+func TestStartRejectsPrivateHosts(t *testing.T) {
+	e := newTestEnv(t)
+	for _, host := range []string{"127.0.0.1", "10.0.0.5:8080", "freefeed.net:6379", "localhost", "[::1]", "198.18.0.1"} {
+		e.run(
+			faketg.Say(alice, "/start "+host),
+			faketg.Expect(alice, "Не похоже на адрес сайта.*"),
+		)
+	}
+
+	// а доменное имя может указывать на внутренний адрес — такие отсекаются при подключении
+	for ip, public := range map[string]bool{
+		"8.8.8.8":          true,
+		"2a00:1450::1":     true,
+		"10.1.2.3":         false,
+		"100.64.0.1":       false,
+		"198.18.0.1":       false,
+		"198.19.255.255":   false,
+		"64:ff9b::a00:1":   false,
+		"::ffff:127.0.0.1": false,
+		"fd00::1":          false,
+	} {
+		if isPublicIP(net.ParseIP(ip)) != public {
+			t.Errorf("isPublicIP(%s) = %v", ip, !public)
+		}
+	}
+}
+
+func TestCancel(t *testing.T) {
+	e := newTestEnv(t)
+	e.login(alice, "alice")
+	e.run(
+		faketg.Say(alice, "/to_bob"),
+		faketg.Expect(alice, "OK, ваше сообщение для bob (/cancel — отмена):"),
+		e.action(alice, ActComposePost),
+		faketg.Say(alice, "/cancel"),
+		faketg.Expect(alice, "OK, операция «создание директ-сообщения» отменена."),
+		e.action(alice, ActNothing),
+		faketg.Say(alice, "/cancel"),
+		faketg.Expect(alice, "Сейчас нечего отменять.*"),
+	)
+}
+
+func TestAccounts(t *testing.T) {
+	e := newTestEnv(t)
+	e.user("carol")
+	e.login(alice, "alice")
+	e.run(
+		faketg.Say(alice, "/add"),
+		faketg.Expect(alice, TokenMessage(e.app.apiHost)),
+		faketg.Expect(alice, "Пожалуйста, введите access token аккаунта*"),
+		e.action(alice, ActNewToken),
+		faketg.Say(alice, "token-carol"),
+		faketg.Expect(alice, "Спасибо, проверяю ваш токен…"),
+		faketg.Expect(alice, "Аккаунт carol подключён и сейчас активен.*"),
+		e.loggedIn(alice, "carol"),
+		faketg.Say(alice, "/accounts"),
+		faketg.Expect(alice, "Ваши аккаунты FreeFeed:\n    /use_alice*"),
+		faketg.Say(alice, "/use_nobody"),
+		faketg.Expect(alice, "У вас нет подключённого аккаунта «nobody».*"),
+		faketg.Say(alice, "/use_alice"),
+		faketg.Expect(alice, "OK, теперь активен аккаунт alice."),
+		e.loggedIn(alice, "alice"),
+		faketg.Say(alice, "/logout"),
+		faketg.Expect(alice, "Аккаунт alice отключён, я стёр его токен. Теперь активен аккаунт carol."),
+		e.loggedIn(alice, "carol"),
+		faketg.Say(alice, "/logout"),
+		faketg.Expect(alice, "Всё, я вас забыл и стёр все данные о вас.*"),
+		e.state(alice, "logged out", func(s *State) bool { return !s.IsAuthorized() }),
+		faketg.Say(alice, "/accounts"),
+		faketg.Expect(alice, "К сожалению, я мало что могу сделать*"),
+	)
+}
+
+func TestContacts(t *testing.T) {
+	e := newTestEnv(t)
+	e.user("bob")
+	e.login(alice, "alice")
+	e.run(
+		faketg.Say(alice, "/contacts"),
+		faketg.Expect(alice, "Похоже, у вас нет взаимных друзей.*"),
+	)
+
+	e.friends("alice", "bob")
+	e.run(
+		faketg.Say(alice, "/contacts"),
+		faketg.Expect(alice, "Ваши взаимные друзья:*"),
+	)
+	if data := e.lastSent(alice).Buttons()["bob"]; data != cbTo+"bob" {
+		t.Errorf("contact button data is %q", data)
+	}
+}
+
+func TestSendDirect(t *testing.T) {
+	e := newTestEnv(t)
+	e.friends("alice", "bob")
+	e.login(alice, "alice")
+	e.run(
+		faketg.Say(alice, "/to_bob"),
+		faketg.Expect(alice, "OK, ваше сообщение для bob (/cancel — отмена):"),
+		e.action(alice, ActComposePost),
+		faketg.Say(alice, "Привет, Боб!"),
+		faketg.Expect(alice, "Сообщение отправлено!"),
+		e.action(alice, ActNothing),
+	)
+	e.postByBody("Привет, Боб!")
+
+	// с незнакомым директ не отправится
+	e.run(
+		faketg.Say(alice, "/to_mallory"),
+		faketg.Expect(alice, "OK, ваше сообщение для mallory (/cancel — отмена):"),
+		e.action(alice, ActComposePost),
+		faketg.Say(alice, "Привет"),
+		faketg.Expect(alice, "Не удалось отправить сообщение*"),
+	)
+}
+
+func TestComment(t *testing.T) {
+	e := newTestEnv(t)
+	e.friends("alice", "bob")
+	// пост создаётся до подключения, чтобы уведомление о нём не вмешалось в сценарий
+	post, err := e.frf.SendDirect("bob", "Как дела?", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.login(alice, "alice")
+
+	e.run(
+		faketg.Say(alice, "/re_"+post.ID),
+		faketg.Expect(alice, "OK, ваш комментарий к сообщению bob «Как дела?» (/cancel — отмена):"),
+		e.action(alice, ActAddComment),
+		faketg.Say(alice, "Отлично!"),
+		faketg.Expect(alice, "Комментарий отправлен!"),
+		faketg.Say(alice, "/re_ffff"),
+		faketg.Expect(alice, "Сообщение не найдено."),
+	)
+	if cc := e.frf.Comments(post.ID); len(cc) != 1 || cc[0].Body != "Отлично!" {
+		t.Fatalf("unexpected comments %+v", cc)
+	}
+
+	// ответ (Reply) на сообщение о посте тоже становится комментарием
+	e.run(
+		faketg.Say(alice, "/list"),
+		faketg.Expect(alice, "Ваши директ-сообщения (1):"),
+		faketg.Expect(alice, "1/1 ✉ bob → вам:*"),
+	)
+	e.replyToLast(alice, "И ещё")
+	e.run(faketg.Expect(alice, "Комментарий отправлен!"))
+	if cc := e.frf.Comments(post.ID); len(cc) != 2 || cc[1].Body != "И ещё" {
+		t.Fatalf("unexpected comments %+v", cc)
+	}
+}
+
+func TestThread(t *testing.T) {
+	e := newTestEnv(t)
+	e.friends("alice", "bob")
+	post, _ := e.frf.SendDirect("bob", "Как дела?", "alice")
+	e.frf.AddComment("alice", post.ID, "Хорошо")
+	e.login(alice, "alice")
+
+	e.run(
+		faketg.Say(alice, "/thread"),
+		faketg.Expect(alice, "Используйте /thread как ответ (Reply)*"),
+		faketg.Say(alice, "/thread_"+post.ID),
+		faketg.Expect(alice, "🧵 bob → вам:\n"+separator+"\nКак дела?\n\n💬 вы:\nХорошо\n"+separator+"\nКомментариев: 1"),
+	)
+}
+
+func TestDelete(t *testing.T) {
+	e := newTestEnv(t)
+	e.friends("alice", "bob")
+	e.login(alice, "alice")
+	e.run(
+		faketg.Say(alice, "/to_bob"),
+		faketg.Expect(alice, "OK, ваше сообщение для bob*"),
+		e.action(alice, ActComposePost),
+		faketg.Say(alice, "Ошибся адресом"),
+		faketg.Expect(alice, "Сообщение отправлено!"),
+	)
+	post := e.postByBody("Ошибся адресом")
+	confirmation := e.lastSent(alice).MessageID
+
+	e.run(
+		faketg.Say(alice, "/delete"),
+		faketg.Expect(alice, "Используйте /delete как ответ (Reply)*"),
+		faketg.Say(alice, "/delete_"+post.ID),
+		faketg.Expect(alice, "Удалить сообщение alice «Ошибся адресом» вместе со всеми комментариями?*"),
+		e.action(alice, ActConfirmDelete),
+		faketg.Say(alice, "нет"),
+		faketg.Expect(alice, "OK, ничего не удаляю."),
+		e.action(alice, ActNothing),
+		faketg.Say(alice, "/delete_"+post.ID),
+		faketg.Expect(alice, "Удалить сообщение*"),
+		e.action(alice, ActConfirmDelete),
+		faketg.Say(alice, "да"),
+		faketg.Expect(alice, "Сообщение удалено."),
+		e.action(alice, ActNothing),
+	)
+	for _, p := range e.frf.Posts() {
+		if p.ID == post.ID {
+			t.Fatal("post is not deleted")
+		}
+	}
+
+	// ответ на сообщение об удалённом посте
+	e.replyTo(alice, confirmation, "Ещё тут?")
+	e.run(faketg.Expect(alice, "Сообщение не найдено."))
+}
+
+// правка и удаление идут от имени аккаунта, которым сообщение было отправлено, а не активного
+func TestEditAndDeleteWithOtherAccount(t *testing.T) {
+	e := newTestEnv(t)
+	e.friends("alice", "bob")
+	e.user("carol")
+	e.login(alice, "alice")
+	e.run(
+		faketg.Say(alice, "/to_bob"),
+		faketg.Expect(alice, "OK, ваше сообщение для bob*"),
+		e.action(alice, ActComposePost),
+	)
+	msgID := e.bot.Say(alice, "Привет")
+	e.run(faketg.Expect(alice, "Сообщение отправлено!"))
+	confirmation := e.lastSent(alice).MessageID
+	post := e.postByBody("Привет")
+
+	e.run(
+		faketg.Say(alice, "/add"),
+		faketg.Expect(alice, TokenMessage(e.app.apiHost)),
+		faketg.Expect(alice, "Пожалуйста, введите access token аккаунта*"),
+		e.action(alice, ActNewToken),
+		faketg.Say(alice, "token-carol"),
+		faketg.Expect(alice, "Спасибо, проверяю ваш токен…"),
+		faketg.Expect(alice, "Аккаунт carol подключён и сейчас активен.*"),
+		e.loggedIn(alice, "carol"),
+	)
+
+	e.bot.Edit(alice, msgID, "Привет!")
+	e.run(faketg.Expect(alice, "Сообщение изменено."))
+	e.postByBody("Привет!")
+
+	e.replyTo(alice, confirmation, "/delete")
+	e.run(
+		faketg.Expect(alice, "Удалить сообщение alice «Привет!» вместе со всеми комментариями?*"),
+		e.state(alice, "deleting as alice", func(s *State) bool {
+			return s.Action == ActConfirmDelete && s.AccountName == "alice" && s.PostID == post.ID
+		}),
+		faketg.Say(alice, "да"),
+		faketg.Expect(alice, "Сообщение удалено."),
+		e.loggedIn(alice, "carol"),
+	)
+	if len(e.frf.Posts()) != 0 {
+		t.Fatal("post is not deleted")
+	}
+}
+
+// ответ (Reply) командой на сообщение о посте относится к этому посту
+func TestCommandsAsReplies(t *testing.T) {
+	e := newTestEnv(t)
+	e.friends("alice", "bob")
+	e.frf.SendDirect("bob", "Как дела?", "alice")
+	e.login(alice, "alice")
+	e.run(
+		faketg.Say(alice, "/list"),
+		faketg.Expect(alice, "Ваши директ-сообщения (1):"),
+		faketg.Expect(alice, "1/1 ✉ bob → вам:*"),
+	)
+	notice := e.lastSent(alice).MessageID
+
+	e.replyTo(alice, notice, "/thread")
+	e.run(faketg.Expect(alice, "🧵 bob → вам:\n"+separator+"\nКак дела?*"))
+
+	// удалить можно только своё сообщение
+	e.replyTo(alice, notice, "/delete")
+	e.run(faketg.Expect(alice, "Используйте /delete как ответ (Reply)*"))
+
+	e.run(
+		faketg.Say(alice, "/to_bob"),
+		faketg.Expect(alice, "OK, ваше сообщение для bob*"),
+		e.action(alice, ActComposePost),
+	)
+	msgID := e.bot.Say(alice, "Моё")
+	e.run(faketg.Expect(alice, "Сообщение отправлено!"))
+	e.bot.Reply(alice, msgID, "/delete")
+	e.run(
+		faketg.Expect(alice, "Удалить сообщение alice «Моё» вместе со всеми комментариями?*"),
+		e.action(alice, ActConfirmDelete),
+		faketg.Say(alice, "/cancel"),
+		faketg.Expect(alice, "OK, операция*"),
+		e.action(alice, ActNothing),
+	)
+	e.postByBody("Моё")
+}
+
+func TestButtons(t *testing.T) {
+	e := newTestEnv(t)
+	e.friends("alice", "bob")
+	post, _ := e.frf.SendDirect("bob", "Как дела?", "alice")
+	e.login(alice, "alice")
+	e.run(
+		faketg.Say(alice, "/list"),
+		faketg.Expect(alice, "Ваши директ-сообщения (1):"),
+		faketg.Expect(alice, "1/1 ✉ bob → вам:*"),
+	)
+	notice := e.lastSent(alice)
+	buttons := notice.Buttons()
+	if buttons["↩ Ответить"] != cbReply+post.ID || buttons["🔕 Не следить"] != cbMute+post.ID {
+		t.Fatalf("unexpected buttons %v", buttons)
+	}
+
+	e.bot.Press(bob, notice.MessageID, cbRead)
+	e.answered("Сначала задайте токен командой /start")
+
+	e.bot.Press(alice, notice.MessageID, cbRead)
+	e.answered("Все директы отмечены прочитанными.")
+
+	e.bot.Press(alice, notice.MessageID, cbMute+post.ID)
+	e.answered("Больше не буду присылать комментарии к этому сообщению.")
+	e.run(faketg.Expect(alice, ""))
+	if edit := e.lastSent(alice); edit.Kind != "edit markup" || edit.MessageID != notice.MessageID ||
+		edit.Buttons()["🔔 Следить"] != cbUnmute+post.ID {
+		t.Fatalf("keyboard is not updated: %+v", edit)
+	}
+	if !e.app.IsMuted(alice, post.ID) {
+		t.Error("post is not muted")
+	}
+
+	e.bot.Press(alice, notice.MessageID, cbThread+post.ID)
+	e.run(faketg.Expect(alice, "🧵 bob → вам:*"))
+
+	e.bot.Press(alice, notice.MessageID, cbTo+"bob")
+	e.run(
+		faketg.Expect(alice, "OK, ваше сообщение для bob (/cancel — отмена):"),
+		e.action(alice, ActComposePost),
+	)
+
+	e.bot.Press(alice, notice.MessageID, cbReply+post.ID)
+	e.run(
+		faketg.Expect(alice, "OK, ваш комментарий к сообщению bob «Как дела?» (/cancel — отмена):"),
+		e.action(alice, ActAddComment),
+		faketg.Say(alice, "Нормально"),
+		faketg.Expect(alice, "Комментарий отправлен!"),
+	)
+	if cc := e.frf.Comments(post.ID); len(cc) != 1 || cc[0].Body != "Нормально" {
+		t.Fatalf("unexpected comments %+v", cc)
+	}
+}
+
+// FreeFeed не принимает файлы в комментариях, а пустой текст не отправляется никуда
+func TestOnlyTextComments(t *testing.T) {
+	e := newTestEnv(t)
+	e.friends("alice", "bob")
+	post, _ := e.frf.SendDirect("bob", "Как дела?", "alice")
+	e.login(alice, "alice")
+
+	e.run(
+		faketg.Say(alice, "/re_"+shortCode(post.ID)),
+		faketg.Expect(alice, "OK, ваш комментарий*"),
+		e.action(alice, ActAddComment),
+	)
+	e.bot.SendPhoto(alice, "photo-1", "")
+	e.run(
+		faketg.Expect(alice, "Извините, комментарий может быть только текстовым: FreeFeed не поддерживает файлы в комментариях.*"),
+		e.action(alice, ActAddComment),
+		faketg.Say(alice, "/cancel"),
+		faketg.Expect(alice, "OK, операция*"),
+		e.action(alice, ActNothing),
+		faketg.Say(alice, "/list"),
+		faketg.Expect(alice, "Ваши директ-сообщения (1):"),
+		faketg.Expect(alice, "1/1 ✉ bob → вам:*"),
+	)
+	e.replyToLast(alice, "")
+	e.run(faketg.Expect(alice, "Извините, комментарий может быть только текстовым. Попробуйте ещё раз?"))
+
+	e.run(
+		faketg.Say(alice, "/to_bob"),
+		faketg.Expect(alice, "OK, ваше сообщение для bob*"),
+		e.action(alice, ActComposePost),
+	)
+	e.bot.Say(alice, "")
+	e.run(
+		faketg.Expect(alice, "Извините, сообщение может быть только текстом, фото или файлом.*"),
+		e.action(alice, ActComposePost),
+	)
+	if cc := e.frf.Comments(post.ID); len(cc) != 0 {
+		t.Fatalf("unexpected comments %+v", cc)
+	}
+	if len(e.frf.Posts()) != 1 {
+		t.Fatal("empty post is created")
+	}
+}
+
+func TestAddWithHost(t *testing.T) {
+	e := newTestEnv(t)
+	e.login(alice, "alice")
+	e.run(
+		faketg.Say(alice, "/add 10.0.0.1"),
+		faketg.Expect(alice, "Не похоже на адрес сайта.*"),
+		e.action(alice, ActNothing),
+		faketg.Say(alice, "/add https://Candy.Example.com/"),
+		faketg.Expect(alice, TokenMessage("candy.example.com")),
+		faketg.Expect(alice, "Пожалуйста, введите access token аккаунта*"),
+		e.state(alice, "token for candy.example.com", func(s *State) bool {
+			return s.Action == ActNewToken && s.Host == "candy.example.com"
+		}),
+		faketg.Say(alice, "/cancel"),
+		faketg.Expect(alice, "OK, операция*"),
+		e.loggedIn(alice, "alice"),
+	)
+}
+
+// аккаунты с одинаковыми именами на разных инстансах различаются по адресу инстанса
+func TestUseAmbiguousAccount(t *testing.T) {
+	e := newTestEnv(t)
+	e.login(alice, "alice")
+	st := e.app.LoadState(alice)
+	st.AddAccount(&frf.User{Name: "alice", AccessToken: "other-token", Host: "candy.example.com"})
+	st.UseAccount(e.app.apiHost, "alice")
+	e.app.SaveState(st)
+
+	e.run(
+		faketg.Say(alice, "/accounts"),
+		faketg.Expect(alice, "Ваши аккаунты FreeFeed:\n    alice (активный)\n    /use_alice candy.example.com на candy.example.com*"),
+		faketg.Say(alice, "/use_alice"),
+		faketg.Expect(alice, "Аккаунт «alice» подключён у вас на нескольких инстансах FreeFeed.*"),
+		faketg.Say(alice, "/use_alice candy.example.com"),
+		faketg.Expect(alice, "OK, теперь активен аккаунт alice."),
+		e.state(alice, "alice on candy.example.com", func(s *State) bool {
+			return s.User != nil && s.User.Host == "candy.example.com"
+		}),
+		faketg.Say(alice, "/use alice "+e.app.apiHost),
+		faketg.Expect(alice, "OK, теперь активен аккаунт alice."),
+		e.state(alice, "alice on the default instance", func(s *State) bool {
+			return s.User != nil && s.User.Host == e.app.apiHost
+		}),
+	)
+}
+
+// пока пользователь заблокировал бота, уведомления не шлются; после /start всё возобновляется
+func TestBlockAndUnblock(t *testing.T) {
+	e := newTestEnv(t)
+	e.friends("alice", "bob")
+	e.login(alice, "alice")
+	e.waitRT(alice, "alice")
+
+	e.bot.Block(alice)
+	e.run(e.state(alice, "paused", func(s *State) bool { return s.Paused }))
+	e.waitFor("realtime is stopped", func() bool { return len(e.app.RTHealth(alice)) == 0 })
+	e.queue.Push(tgbotapi.NewMessage(alice, "Не дойдёт"))
+	e.waitFor("message to the blocked user is dropped", func() bool { return e.queue.queued(alice) == 0 })
+
+	e.bot.Unblock(alice)
+	e.run(
+		faketg.Expect(alice, "С возвращением, alice!*"),
+		e.state(alice, "resumed", func(s *State) bool { return !s.Paused }),
+	)
+	e.waitRT(alice, "alice")
+	post, err := e.frf.SendDirect("bob", "Снова тут?", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.run(faketg.Expect(alice, "📨 bob написал вам:\n"+separator+"\nСнова тут?\n"+separator+"\n№ "+shortCode(post.ID)))
+	for _, s := range e.bot.Sent() {
+		if s.Text == "Не дойдёт" {
+			t.Error("message is sent to the blocked user")
+		}
+	}
+}
+
+// на 429 бот ждёт, сколько попросил Telegram, и отправляет сообщение снова
+func TestTooManyRequests(t *testing.T) {
+	e := newTestEnv(t)
+	e.login(alice, "alice")
+	time.Sleep(time.Second) // лимит чата восстанавливается после входа
+
+	e.bot.FailNext(faketg.TooManyRequests(2))
+	start := time.Now()
+	e.run(
+		faketg.Say(alice, "/cancel"),
+		faketg.Expect(alice, "Сейчас нечего отменять.*"),
+	)
+	if d := time.Since(start); d < 2*time.Second {
+		t.Errorf("message is resent after %v, before retry_after", d)
+	}
+}
+
+func TestList(t *testing.T) {
+	e := newTestEnv(t)
+	e.user("alice")
+	e.login(alice, "alice")
+	e.run(
+		faketg.Say(alice, "/list"),
+		faketg.Expect(alice, "Похоже, у вас нет директ-сообщений."),
+	)
+
+	e.friends("alice", "bob")
+	e.run(
+		faketg.Say(alice, "/to_bob"),
+		faketg.Expect(alice, "OK, ваше сообщение для bob*"),
+		e.action(alice, ActComposePost),
+		faketg.Say(alice, "Первое"),
+		faketg.Expect(alice, "Сообщение отправлено!"),
+		faketg.Say(alice, "/to_bob"),
+		faketg.Expect(alice, "OK, ваше сообщение для bob*"),
+		e.action(alice, ActComposePost),
+		faketg.Say(alice, "Второе"),
+		faketg.Expect(alice, "Сообщение отправлено!"),
+		faketg.Say(alice, "/list 1"),
+		faketg.Expect(alice, "Ваши директ-сообщения (1):"),
+		faketg.Expect(alice, "1/1 ✉ вы → bob:\n"+separator+"\nВторое*"),
+		faketg.Expect(alice, "Показать более ранние: /list more"),
+		faketg.Say(alice, "/list more"),
+		faketg.Expect(alice, "Более ранние директ-сообщения (1):"),
+		faketg.Expect(alice, "1/1 ✉ вы → bob:\n"+separator+"\nПервое*"),
+		faketg.Say(alice, "/list more"),
+		faketg.Expect(alice, "Больше директ-сообщений нет."),
+	)
+}
+
+func TestUnknownCommand(t *testing.T) {
+	e := newTestEnv(t)
+	e.login(alice, "alice")
+	e.run(
+		faketg.Say(alice, "абракадабра"),
+		faketg.Expect(alice, "Простите, не понимаю.*"),
+		faketg.Say(alice, "/frobnicate"),
+		faketg.Expect(alice, "Простите, не понимаю.*"),
+	)
+}
+
+// у каждого пользователя Telegram свой набор аккаунтов
+func TestUsersAreSeparate(t *testing.T) {
+	e := newTestEnv(t)
+	e.login(alice, "alice")
+	e.run(
+		faketg.Say(bob, "/accounts"),
+		faketg.Expect(bob, "К сожалению, я мало что могу сделать*"),
+	)
+	if !strings.Contains(e.app.LoadState(alice).User.Name, "alice") || e.app.LoadState(bob).IsAuthorized() {
+		t.Fatal("states are mixed up")
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Адрес инстанса, который указал пользователь, — только доменное имя без порта, и подключаться к нему
+// можно лишь по публичным IP-адресам. Инстанс по умолчанию (-apihost) задаёт администратор, для него ограничений нет.
+
+var hostRe = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9-]*[a-z0-9])?)+$`)
+
+// numericTLDRe — имена вроде 10.0.0.5: домен верхнего уровня не бывает числом
+var numericTLDRe = regexp.MustCompile(`\.[0-9]+$`)
+
+var errPrivateAddress = errors.New("адрес инстанса не является публичным")
+
+// parseHost разбирает адрес инстанса FreeFeed из аргумента команды; пустой аргумент — инстанс по умолчанию
+func (a *App) parseHost(arg string) (string, bool) {
+	host := strings.ToLower(strings.TrimSpace(arg))
+	host = strings.TrimPrefix(strings.TrimPrefix(host, "https://"), "http://")
+	host = strings.TrimSuffix(host, "/")
+	if host == "" || host == a.apiHost {
+		return a.apiHost, true
+	}
+	return host, hostRe.MatchString(host) && !numericTLDRe.MatchString(host) && net.ParseIP(host) == nil
+}
+
+var privateNets = func() (nets []*net.IPNet) {
+	for _, cidr := range []string{
+		"0.0.0.0/8",
+		"10.0.0.0/8",
+		"100.64.0.0/10",
+		"127.0.0.0/8",
+		"169.254.0.0/16",
+		"172.16.0.0/12",
+		"192.168.0.0/16",
+		"198.18.0.0/15", // сети для тестирования производительности
+		"::/128",
+		"::1/128",
+		"64:ff9b::/96", // NAT64: за ним может оказаться любой IPv4-адрес, в том числе внутренний
+		"fc00::/7",
+		"fe80::/10",
+	} {
+		_, n, _ := net.ParseCIDR(cidr)
+		nets = append(nets, n)
+	}
+	return
+}()
+
+func isPublicIP(ip net.IP) bool {
+	if ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// publicDialer подключается только к публичным адресам
+var publicDialer = &net.Dialer{
+	Timeout:   30 * time.Second,
+	KeepAlive: 30 * time.Second,
+	Control: func(network, address string, _ syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+			return errPrivateAddress
+		}
+		return nil
+	},
+}
+
+var publicClient = func() *http.Client {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil // через прокси проверка адреса не сработает
+	t.DialContext = publicDialer.DialContext
+	return &http.Client{Transport: t}
+}()
+
+// hostClient возвращает HTTP-клиент для запросов к инстансу host
+func (a *App) hostClient(host string) *http.Client {
+	if host == a.apiHost {
+		return a.client()
+	}
+	return publicClient
+}
+
+// wsDialer возвращает websocket-диалер для realtime-соединений с инстансом host
+func (a *App) wsDialer(host string) *websocket.Dialer {
+	if host == a.apiHost {
+		return websocket.DefaultDialer
+	}
+	return &websocket.Dialer{
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return publicDialer.DialContext(ctx, network, addr)
+		},
+		HandshakeTimeout: websocket.DefaultDialer.HandshakeTimeout,
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"strings"
+)
+
+// Зашифрованный токен хранится в виде строки
+//
+//	enc:v1:<id ключа>:<зашифрованный ключ данных>:<зашифрованный токен>
+//
+// Каждый токен шифруется своим случайным ключом данных (AES-256-GCM),
+// а ключ данных — мастер-ключом из флага или файла (envelope encryption).
+const sealedPrefix = "enc:v1:"
+
+var (
+	ErrBadKey       = errors.New("Encryption key must be 32 bytes, raw or base64-encoded")
+	ErrWrongKey     = errors.New("Token is encrypted with another key")
+	ErrNoKey        = errors.New("Token is encrypted but no encryption key is given")
+	ErrBadSealedStr = errors.New("Malformed encrypted token")
+)
+
+type Keyring struct {
+	id  string
+	kek cipher.AEAD
+}
+
+func NewKeyring(key []byte) (*Keyring, error) {
+	if len(key) != 32 {
+		return nil, ErrBadKey
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(key)
+	return &Keyring{id: hex.EncodeToString(sum[:4]), kek: aead}, nil
+}
+
+// ParseKey принимает ключ в base64 или как 32 байта «как есть»
+func ParseKey(data []byte) ([]byte, error) {
+	s := strings.TrimSpace(string(data))
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if len(data) == 32 {
+		return data, nil
+	}
+	return nil, ErrBadKey
+}
+
+func LoadKeyring(keyStr, keyFile string) (*Keyring, error) {
+	var data []byte
+	if keyFile != "" {
+		d, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		data = d
+	} else if keyStr != "" {
+		data = []byte(keyStr)
+	} else {
+		return nil, nil
+	}
+	key, err := ParseKey(data)
+	if err != nil {
+		return nil, err
+	}
+	return NewKeyring(key)
+}
+
+func IsSealed(s string) bool { return strings.HasPrefix(s, sealedPrefix) }
+
+func (k *Keyring) Seal(plain string) (string, error) {
+	dek := make([]byte, 32)
+	if _, err := rand.Read(dek); err != nil {
+		return "", err
+	}
+	dekAEAD, err := newGCM(dek)
+	if err != nil {
+		return "", err
+	}
+	wrapped, err := seal(k.kek, dek)
+	if err != nil {
+		return "", err
+	}
+	ct, err := seal(dekAEAD, []byte(plain))
+	if err != nil {
+		return "", err
+	}
+	return sealedPrefix + k.id + ":" +
+		base64.RawStdEncoding.EncodeToString(wrapped) + ":" +
+		base64.RawStdEncoding.EncodeToString(ct), nil
+}
+
+// Open расшифровывает токен. Незашифрованные токены (записанные до включения шифрования) возвращаются как есть.
+func (k *Keyring) Open(sealed string) (string, error) {
+	if !IsSealed(sealed) {
+		return sealed, nil
+	}
+	if k == nil {
+		return "", ErrNoKey
+	}
+	parts := strings.Split(strings.TrimPrefix(sealed, sealedPrefix), ":")
+	if len(parts) != 3 {
+		return "", ErrBadSealedStr
+	}
+	if parts[0] != k.id {
+		return "", ErrWrongKey
+	}
+	wrapped, err1 := base64.RawStdEncoding.DecodeString(parts[1])
+	ct, err2 := base64.RawStdEncoding.DecodeString(parts[2])
+	if err1 != nil || err2 != nil {
+		return "", ErrBadSealedStr
+	}
+	dek, err := open(k.kek, wrapped)
+	if err != nil {
+		return "", err
+	}
+	dekAEAD, err := newGCM(dek)
+	if err != nil {
+		return "", err
+	}
+	plain, err := open(dekAEAD, ct)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func seal(aead cipher.AEAD, plain []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plain, nil), nil
+}
+
+func open(aead cipher.AEAD, data []byte) ([]byte, error) {
+	if len(data) < aead.NonceSize() {
+		return nil, ErrBadSealedStr
+	}
+	return aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/davidmz/FreefeedDirectBot/frf"
+)
+
+func testKeyring(t *testing.T, fill byte) *Keyring {
+	t.Helper()
+	k, err := NewKeyring(bytes.Repeat([]byte{fill}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestSealOpen(t *testing.T) {
+	k := testKeyring(t, 1)
+	sealed, err := k.Seal("secret-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsSealed(sealed) || strings.Contains(sealed, "secret-token") {
+		t.Fatalf("token is not sealed: %q", sealed)
+	}
+	if again, _ := k.Seal("secret-token"); again == sealed {
+		t.Error("sealing is not randomized")
+	}
+	if plain, err := k.Open(sealed); err != nil || plain != "secret-token" {
+		t.Errorf("Open = %q, %v", plain, err)
+	}
+	// открытые токены, записанные до включения шифрования
+	if plain, err := k.Open("old-token"); err != nil || plain != "old-token" {
+		t.Errorf("Open of a plain token = %q, %v", plain, err)
+	}
+
+	if _, err := testKeyring(t, 2).Open(sealed); err != ErrWrongKey {
+		t.Errorf("Open with a wrong key: %v, want ErrWrongKey", err)
+	}
+	if _, err := (*Keyring)(nil).Open(sealed); err != ErrNoKey {
+		t.Errorf("Open without a key: %v, want ErrNoKey", err)
+	}
+	if _, err := k.Open(sealed + ":x"); err != ErrBadSealedStr {
+		t.Errorf("Open of a malformed token: %v, want ErrBadSealedStr", err)
+	}
+
+	// испорченный шифротекст не должен расшифровываться
+	parts := strings.Split(sealed, ":")
+	ct, _ := base64.RawStdEncoding.DecodeString(parts[len(parts)-1])
+	ct[len(ct)-1] ^= 1
+	parts[len(parts)-1] = base64.RawStdEncoding.EncodeToString(ct)
+	if plain, err := k.Open(strings.Join(parts, ":")); err == nil {
+		t.Errorf("tampered token is opened as %q", plain)
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	for name, data := range map[string][]byte{
+		"base64":         []byte(base64.StdEncoding.EncodeToString(key)),
+		"base64 newline": []byte(base64.StdEncoding.EncodeToString(key) + "\n"),
+		"raw":            key,
+	} {
+		if got, err := ParseKey(data); err != nil || !bytes.Equal(got, key) {
+			t.Errorf("%s: ParseKey = %v, %v", name, got, err)
+		}
+	}
+	if _, err := ParseKey([]byte("short")); err != ErrBadKey {
+		t.Errorf("ParseKey of a short key: %v, want ErrBadKey", err)
+	}
+}
+
+func TestReencryptStates(t *testing.T) {
+	e := newTestEnv(t)
+	raw := func() []byte {
+		var data []byte
+		e.app.db.View(func(tx *bolt.Tx) error {
+			data = append(data, tx.Bucket(StatesBucket).Get([]byte("1001"))...)
+			return nil
+		})
+		return data
+	}
+	user := &frf.User{Name: "alice", AccessToken: "token-alice", Host: e.app.apiHost}
+	st := &State{stateBase: stateBase{UserID: alice, User: user, Accounts: []*frf.User{user}}}
+	e.app.SaveState(st)
+	if !bytes.Contains(raw(), []byte("token-alice")) {
+		t.Fatal("state without a key is not stored in plain text")
+	}
+
+	// миграция открытой записи
+	k1 := testKeyring(t, 1)
+	if n, err := e.app.ReencryptStates(k1, false); err != nil || n != 1 {
+		t.Fatalf("migration: %d, %v", n, err)
+	}
+	e.app.keys = k1
+	if data := raw(); bytes.Contains(data, []byte("token-alice")) || !bytes.Contains(data, []byte(sealedPrefix)) {
+		t.Fatalf("token is not encrypted: %s", data)
+	}
+	if n, err := e.app.ReencryptStates(k1, false); err != nil || n != 0 {
+		t.Errorf("second migration: %d, %v", n, err)
+	}
+	if got := e.app.LoadState(alice); got.User == nil || got.User.AccessToken != "token-alice" {
+		t.Fatalf("unexpected state %+v", got)
+	}
+
+	// смена ключа
+	k2 := testKeyring(t, 2)
+	if n, err := e.app.ReencryptStates(k2, true); err != nil || n != 1 {
+		t.Fatalf("rotation: %d, %v", n, err)
+	}
+	if _, err := e.app.ReencryptStates(k1, false); err == nil {
+		t.Error("states encrypted with a new key are read with the old one")
+	}
+	e.app.keys = k2
+	if got := e.app.LoadState(alice); got.User == nil || got.User.AccessToken != "token-alice" ||
+		len(got.Accounts) != 1 || got.Accounts[0].AccessToken != "token-alice" {
+		t.Errorf("unexpected state after rotation %+v", got)
+	}
+}
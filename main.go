@@ -1,7 +1,7 @@
 package main
 
 import (
-	"errors"
+	"context"
 	"flag"
 	"log"
 	"time"
@@ -13,9 +13,11 @@ import (
 )
 
 var (
-	StatesBucket = []byte("States")
-
-	ErrNotFound = errors.New("Not Found")
+	StatesBucket       = []byte("States")
+	PostMessagesBucket = []byte("PostMessages")
+	MutedBucket        = []byte("Muted")
+	SentMessagesBucket = []byte("SentMessages")
+	NoticesBucket      = []byte("Notices")
 )
 
 func main() {
@@ -24,59 +26,115 @@ func main() {
 	var (
 		botToken   string
 		apiHost    string
+		apiScheme  string
+		apiTimeout time.Duration
 		dbFileName string
 		userAgent  string
+		encKey     string
+		keyFile    string
+		rotateFile string
+		rtLimit    int
+		keepDays   int
 	)
 
 	flag.StringVar(&botToken, "token", "", "telegram bot token")
 	flag.StringVar(&apiHost, "apihost", "freefeed.net", "backend API host")
+	flag.StringVar(&apiScheme, "apischeme", "https", "backend API scheme (http for a local server)")
+	flag.DurationVar(&apiTimeout, "apitimeout", 30*time.Second, "timeout of a single backend API request")
 	flag.StringVar(&dbFileName, "dbfile", "", "database file name")
+	flag.IntVar(&rtLimit, "rtconns", 1000, "max number of realtime connections, other accounts are polled (0 - no limit)")
+	flag.IntVar(&keepDays, "keepdays", 90, "forget messages older than this number of days: replies to them stop working (0 - keep forever)")
 	flag.StringVar(&userAgent, "ua", "", "User-Agent for backend requests")
+	flag.StringVar(&encKey, "key", "", "base64-encoded 32-byte key for encrypting stored access tokens")
+	flag.StringVar(&keyFile, "keyfile", "", "file with the key for encrypting stored access tokens (overrides -key)")
+	flag.StringVar(&rotateFile, "rotate-keyfile", "", "re-encrypt all stored tokens with the key from this file and exit")
 	flag.Parse()
 
-	if botToken == "" || dbFileName == "" {
+	if dbFileName == "" || (botToken == "" && rotateFile == "") {
 		flag.Usage()
 		return
 	}
 
+	keys := mustbe.OKVal(LoadKeyring(encKey, keyFile)).(*Keyring)
+
 	db := mustbe.OKVal(bolt.Open(dbFileName, 0600, &bolt.Options{Timeout: 1 * time.Second})).(*bolt.DB)
 	defer db.Close()
 
-	mustbe.OK(db.Update(func(tx *bolt.Tx) error {
-		mustbe.OKVal(tx.CreateBucketIfNotExists(StatesBucket))
-		return nil
-	}))
-
-	bot := mustbe.OKVal(tgbotapi.NewBotAPI(botToken)).(*tgbotapi.BotAPI)
-
-	u := tgbotapi.NewUpdate(0)
-	u.Timeout = 60
+	mustbe.OK(db.Update(createBuckets))
 
-	updates, err := bot.GetUpdatesChan(u)
-	if err != nil {
-		log.Fatalln("Can not get update chan:", err)
+	if rotateFile != "" {
+		newKeys := mustbe.OKVal(LoadKeyring("", rotateFile)).(*Keyring)
+		app := &App{db: db, keys: keys}
+		n := mustbe.OKVal(app.ReencryptStates(newKeys, true)).(int)
+		log.Println("Re-encrypted", n, "records, now use", rotateFile, "as -keyfile")
 		return
 	}
 
+	bot := mustbe.OKVal(tgbotapi.NewBotAPI(botToken)).(*tgbotapi.BotAPI)
+
+	updates := GetUpdatesChan(bot, 60)
+
 	log.Println("Starting bot", bot.Self.UserName)
 
 	app := &App{
-		db:        db,
-		apiHost:   apiHost,
-		userAgent: userAgent,
-		outbox:    make(chan tgbotapi.Chattable, 0),
-		rts:       make(map[TgUserID]*Realtime),
-		cache:     gcache.New(1000).ARC().Build(),
+		db:         db,
+		bot:        bot,
+		keys:       keys,
+		apiHost:    apiHost,
+		apiScheme:  apiScheme,
+		apiTimeout: apiTimeout,
+		userAgent:  userAgent,
+		outbox:     make(chan tgbotapi.Chattable, 0),
+		rts:        make(map[rtKey]*Realtime),
+		conns:      make(map[string]*Realtime),
+		rtLimit:    rtLimit,
+		dialSem:    make(chan struct{}, maxConcurrentDials),
+		cache:      gcache.New(1000).ARC().Build(),
+		ignored:    make(map[string]int),
 	}
 
+	// миграция записей с открытыми токенами; заодно проверяем, что ключ подходит
+	if n, err := app.ReencryptStates(keys, false); err != nil {
+		log.Fatalln("Can not read stored states:", err)
+	} else if n > 0 {
+		log.Println("Encrypted tokens in", n, "records")
+	}
+	if keys == nil {
+		log.Println("Warning: access tokens are stored unencrypted, use -key or -keyfile")
+	}
+	if keepDays > 0 {
+		if n, err := app.PruneRecords(time.Now().AddDate(0, 0, -keepDays)); err != nil {
+			log.Println("Can not prune old messages:", err)
+		} else if n > 0 {
+			log.Println("Forgot", n, "old messages")
+		}
+	}
+
+	delivery := NewDelivery(db, bot, app.OnSent, func(chatID int64) { app.PauseUser(TgUserID(chatID)) })
+	delivery.Load()
+	go delivery.Run()
+
 	app.LoadRT()
+	go app.RunPolling()
+
+	app.Serve(context.Background(), updates, delivery)
+}
 
-	for {
-		select {
-		case update := <-updates:
-			go app.HandleMessage(update.Message)
-		case msg := <-app.outbox:
-			bot.Send(msg)
+// createBuckets создаёт бакеты базы, которых в ней ещё нет
+func createBuckets(tx *bolt.Tx) error {
+	for _, name := range [][]byte{
+		StatesBucket,
+		PostMessagesBucket,
+		MutedBucket,
+		SentMessagesBucket,
+		NoticesBucket,
+		OutboxBucket,
+		WatermarksBucket,
+		GroupsBucket,
+	} {
+		if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+			return err
 		}
 	}
+	return nil
 }
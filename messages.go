@@ -1,19 +1,47 @@
 package main
 
-var HelloMessages = []string{
-	"Привет, я FreeFeed Direct bot! Я умею следить за директами на сайте freefeed.net и присылать новые " +
-		"директы или комментарии к ним. Также я позволяю писать директы или отвечать на них " +
-		"прямо в Telegram, не заходя во FreeFeed. Меня сделал FreeFeed-юзер davidmz.",
+func HelloMessages(host string) []string {
+	return []string{
+		"Привет, я FreeFeed Direct bot! Я умею следить за директами на сайте " + host + " и присылать новые " +
+			"директы или комментарии к ним. Также я позволяю писать директы или отвечать на них " +
+			"прямо в Telegram, не заходя во FreeFeed. Меня сделал FreeFeed-юзер davidmz.\n\n" +
+			"Если вы пользуетесь другим инстансом FreeFeed, укажите его адрес в команде, например: /start candy.freefeed.net",
 
-	"Но чтобы читать и пересылать вам директы, мне нужен ваш access token. " +
-		"Получить его можно на странице настроек FreeFeed-а вот по этой ссылке: " +
-		"https://freefeed.net/settings/app-tokens/create?title=Telegram%20Direct%20Bot&scopes=read-realtime%20read-feeds%20manage-posts%20read-my-info",
+		TokenMessage(host),
 
-	"Я обещаю использовать токен только для помощи вам с директами " +
-		"и ни в коем случае не сохранять и не пересылать куда-либо вашу переписку. " +
-		"Вы в любой момент сможете заставить меня стереть все ваши данные, введя коменду /logout",
+		"Я обещаю использовать токен только для помощи вам с директами " +
+			"и ни в коем случае не сохранять и не пересылать куда-либо вашу переписку. " +
+			"Вы в любой момент сможете заставить меня стереть все ваши данные, введя коменду /logout",
 
-	"Пожалуйста, введите ваш access token:",
+		"Пожалуйста, введите ваш access token:",
+	}
+}
+
+func TokenMessage(host string) string {
+	return "Но чтобы читать и пересылать вам директы, мне нужен ваш access token. " +
+		"Получить его можно на странице настроек FreeFeed-а вот по этой ссылке: " + tokenURL(host)
+}
+
+func ReauthMessage(account, host string) string {
+	return tokenRejected(account) +
+		"Создайте новый токен по этой ссылке: " + tokenURL(host) + "\n" +
+		"и пришлите его следующим сообщением (/cancel — отмена)."
+}
+
+// ReauthLaterMessage — то же, но пользователь занят другой операцией и подключит новый токен командой addCmd
+func ReauthLaterMessage(account, host, addCmd string) string {
+	return tokenRejected(account) +
+		"Создайте новый токен по этой ссылке: " + tokenURL(host) + "\n" +
+		"и подключите его командой " + addCmd + " — он заменит старый."
+}
+
+func tokenRejected(account string) string {
+	return "Токен аккаунта " + account + " больше не действует — возможно, он был отозван или истёк. " +
+		"Уведомления для этого аккаунта приостановлены.\n\n"
+}
+
+func tokenURL(host string) string {
+	return "https://" + host + "/settings/app-tokens/create?title=Telegram%20Direct%20Bot&scopes=read-realtime%20read-feeds%20manage-posts%20read-my-info"
 }
 
 var HelpMessage = "Я FreeFeed Direct bot. Я умею следить за директами на сайте freefeed.net и присылать новые " +
@@ -23,10 +51,32 @@ var HelpMessage = "Я FreeFeed Direct bot. Я умею следить за ди
 
 /contacts — показать список взаимных друзей
 /list [count=5] — показать count недавно созданных/изменённых сообщений
-/to_xxx — отправить сообщение пользователю xxx
+/list more [count=5] — показать count следующих, более ранних сообщений
+/to_xxx — отправить сообщение (текст, фото или файл) пользователю xxx
 /re_xxx — прокомментировать директ-сообщение № xxx
+/thread_xxx — показать директ-сообщение № xxx со всеми комментариями
+/delete — удалить ваше сообщение или комментарий (ответом на него) или директ /delete_xxx
 /cancel — отменить исполнение текущей команды
-/logout — забыть токен FreeFeed-а
-/start — начать работу и задать токен FreeFeed-а
+/accounts — показать подключённые аккаунты FreeFeed
+/use name — сделать активным аккаунт name
+/add [host] — подключить ещё один аккаунт FreeFeed (возможно, на другом инстансе)
+/logout — забыть токен активного аккаунта FreeFeed
+/start [host] — начать работу и задать токен FreeFeed-а (по умолчанию на freefeed.net)
 /help — показать список команд
+
+Под каждым сообщением о директе есть кнопки: «Ответить», «Обсуждение», «Открыть» на сайте, «Не следить» за комментариями и «Прочитано». ` +
+	`Ответить на директ можно и просто ответом (Reply) на моё сообщение.
+Номер директа (xxx в командах) указан внизу каждого уведомления о нём.
+Если вы отредактируете отправленное через меня сообщение, я изменю и пост или комментарий во FreeFeed.
+
+Директ с несколькими адресатами можно обсуждать в группе Telegram: добавьте меня в группу и напишите там /bind xxx (это может сделать администратор группы).
 `
+
+var GroupHelpMessage = `Команды в группе:
+
+/bind xxx — связать группу с директом № xxx (директ должен быть с несколькими адресатами, связывает администратор группы, а участники директа получают об этом комментарий)
+/unbind — отвязать группу от директа (тоже только администратор группы; участники директа получат об этом комментарий)
+/help — показать список команд
+
+Новые комментарии к связанному директу появляются в группе. Участники директа, подключившие свои аккаунты FreeFeed в личном чате со мной, могут писать прямо в группу — их сообщения станут комментариями. Сообщения остальных не отправляются.
+Если в группе включён режим приватности ботов, я вижу только команды и ответы (Reply) на мои сообщения.`
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/davidmz/FreefeedDirectBot/frf"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// postMessage — сообщение, относящееся к посту FreeFeed.
+// После отправки запоминаем, к какому посту оно относится, чтобы работал ответ (Reply) на него.
+type postMessage struct {
+	tgbotapi.MessageConfig
+	PostID  string
+	Account string    // аккаунт FreeFeed, от имени которого надо отвечать на это сообщение
+	Host    string    // инстанс этого аккаунта
+	Sent    *sentItem // если это подтверждение отправки: созданный пост или комментарий
+	Notice  *notice   // если это уведомление о посте или комментарии
+}
+
+// notice — уведомление о посте или комментарии, которое надо обновлять при их изменении во FreeFeed
+type notice struct {
+	PostID    string `json:"-"`
+	CommentID string `json:"-"`
+	Header    string
+	Author    string // автор поста
+	Account   string // аккаунт-получатель
+	Host      string // инстанс FreeFeed аккаунта-получателя
+	Part      int    `json:",omitempty"` // номер части, если уведомление разбито на несколько сообщений
+	Parts     int    `json:",omitempty"`
+	Time      int64  // когда отправлено уведомление; старые записи удаляет PruneRecords
+}
+
+var separator = strings.Repeat("\u2500", 10)
+
+// Text — текст уведомления. Внизу указан номер директа для команд /re_xxx, /thread_xxx и т. п.
+func (n *notice) Text(body string) string {
+	return n.Header + "\n" + separator + "\n" + body + "\n" + separator + "\n№ " + shortCode(n.PostID)
+}
+
+// shortCode — короткий номер поста, по которому его находят команды /re_xxx, /thread_xxx и т. п.
+func shortCode(postID string) string {
+	const codeLen = 4
+	if len(postID) < codeLen {
+		return postID
+	}
+	return postID[:codeLen]
+}
+
+// Данные кнопок (callback data)
+const (
+	cbReply  = "re:"
+	cbThread = "thread:"
+	cbTo     = "to:"
+	cbMute   = "mute:"
+	cbUnmute = "unmute:"
+	cbRead   = "read"
+)
+
+func (a *App) postURL(host, author, postID string) string {
+	if host == "" {
+		host = a.apiHost
+	}
+	return a.baseURL(host) + "/" + author + "/" + postID
+}
+
+func (a *App) postKeyboard(userID TgUserID, host, author, postID string) tgbotapi.InlineKeyboardMarkup {
+	muteBtn := tgbotapi.NewInlineKeyboardButtonData("🔕 Не следить", cbMute+postID)
+	if a.IsMuted(userID, postID) {
+		muteBtn = tgbotapi.NewInlineKeyboardButtonData("🔔 Следить", cbUnmute+postID)
+	}
+	return tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("↩ Ответить", cbReply+postID),
+			tgbotapi.NewInlineKeyboardButtonData("🧵 Обсуждение", cbThread+postID),
+			tgbotapi.NewInlineKeyboardButtonURL("Открыть", a.postURL(host, author, postID)),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			muteBtn,
+			tgbotapi.NewInlineKeyboardButtonData("✔ Прочитано", cbRead),
+		),
+	)
+}
+
+func (a *App) newPostMessage(chatID TgUserID, host, account string, text string, author, postID string) postMessage {
+	m := tgbotapi.NewMessage(chatID, text)
+	m.DisableWebPagePreview = true
+	m.ReplyMarkup = a.postKeyboard(chatID, host, author, postID)
+	return postMessage{MessageConfig: m, PostID: postID, Account: account, Host: host}
+}
+
+// SendPost отправляет сообщение о посте с кнопками действий
+func (a *App) SendPost(chatID TgUserID, account *frf.User, text string, author, postID string) {
+	a.outbox <- a.newPostMessage(chatID, a.hostOf(account), account.Name, text, author, postID)
+}
+
+// SendNotice отправляет уведомление о посте (commentID == "") или комментарии
+func (a *App) SendNotice(chatID TgUserID, n *notice, body string) {
+	pm := a.newPostMessage(chatID, n.Host, n.Account, n.Text(body), n.Author, n.PostID)
+	pm.Notice = n
+	a.outbox <- pm
+}
+
+// SendSentConfirmation сообщает об успешной отправке поста или комментария
+func (a *App) SendSentConfirmation(chatID TgUserID, account *frf.User, text string, author string, item *sentItem) {
+	pm := a.newPostMessage(chatID, a.hostOf(account), account.Name, text, author, item.PostID)
+	pm.Sent = item
+	a.outbox <- pm
+}
+
+// OnSent вызывается после успешной отправки сообщения в Telegram
+func (a *App) OnSent(msg tgbotapi.Chattable, sent tgbotapi.Message) {
+	if pm, ok := msg.(postMessage); ok && sent.Chat != nil {
+		if pm.PostID != "" {
+			a.db.Update(func(tx *bolt.Tx) error {
+				data, _ := json.Marshal(&postRef{PostID: pm.PostID, Account: pm.Account, Host: pm.Host, Time: time.Now().Unix()})
+				return tx.Bucket(PostMessagesBucket).Put(msgKey(sent.Chat.ID, sent.MessageID), data)
+			})
+		}
+		if pm.Sent != nil {
+			a.rememberSent(sent.Chat.ID, sent.MessageID, pm.Sent)
+		}
+		if pm.Notice != nil {
+			a.db.Update(func(tx *bolt.Tx) error {
+				rec := *pm.Notice
+				rec.Time = time.Now().Unix()
+				data, _ := json.Marshal(&rec)
+				key := noticeKey(pm.Notice.PostID, pm.Notice.CommentID, sent.Chat.ID, sent.MessageID)
+				return tx.Bucket(NoticesBucket).Put(key, data)
+			})
+		}
+	}
+}
+
+type noticeRef struct {
+	*notice
+	ChatID    int64
+	MessageID int
+}
+
+// findNotices возвращает уведомления в чате chatID о посте postID или о его комментарии commentID.
+// Если allComments == true, возвращаются уведомления и о посте, и обо всех его комментариях.
+func (a *App) findNotices(chatID int64, postID, commentID string, allComments bool) (refs []*noticeRef) {
+	prefix := []byte(postID + "/")
+	if !allComments {
+		prefix = append(prefix, []byte(commentID+"/")...)
+	}
+	a.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(NoticesBucket).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			parts := strings.Split(string(k), "/")
+			if len(parts) != 4 || parts[2] != strconv.FormatInt(chatID, 10) {
+				continue
+			}
+			ref := &noticeRef{notice: new(notice), ChatID: chatID}
+			ref.PostID, ref.CommentID = parts[0], parts[1]
+			ref.MessageID, _ = strconv.Atoi(parts[3])
+			if json.Unmarshal(v, ref.notice) == nil {
+				refs = append(refs, ref)
+			}
+		}
+		return nil
+	})
+	return
+}
+
+func (a *App) forgetNotice(ref *noticeRef) {
+	a.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(NoticesBucket).Delete(noticeKey(ref.PostID, ref.CommentID, ref.ChatID, ref.MessageID))
+	})
+}
+
+// isLastPart сообщает, что это последняя (или единственная) часть уведомления: у неё кнопки и полный текст
+func (n *notice) isLastPart() bool { return n.Part == n.Parts }
+
+// UpdateNotices заменяет текст уведомлений о посте или комментарии после их изменения во FreeFeed.
+// Уведомление из нескольких частей сворачивается в последнюю часть, при необходимости сокращённую.
+func (a *App) UpdateNotices(chatID TgUserID, postID, commentID string, body string) {
+	for _, ref := range a.findNotices(chatID, postID, commentID, false) {
+		if !ref.isLastPart() {
+			a.outbox <- tgbotapi.NewEditMessageText(ref.ChatID, ref.MessageID, "✏️ изменено, новый текст — в последней части уведомления")
+			continue
+		}
+		e := tgbotapi.NewEditMessageText(ref.ChatID, ref.MessageID, shorten(ref.Text(body), maxMessageLen, "\n✏️ изменено"))
+		e.DisableWebPagePreview = true
+		kb := a.postKeyboard(chatID, ref.Host, ref.Author, ref.PostID)
+		e.ReplyMarkup = &kb
+		a.outbox <- e
+	}
+}
+
+// DestroyNotices помечает уведомления об удалённом посте (и его комментариях) или комментарии
+func (a *App) DestroyNotices(chatID TgUserID, postID, commentID string) {
+	for _, ref := range a.findNotices(chatID, postID, commentID, commentID == "") {
+		e := tgbotapi.NewEditMessageText(ref.ChatID, ref.MessageID, ref.Text("🗑 удалено во FreeFeed"))
+		e.DisableWebPagePreview = true
+		if commentID != "" && ref.isLastPart() {
+			// пост остался, на него ещё можно ответить
+			kb := a.postKeyboard(chatID, ref.Host, ref.Author, ref.PostID)
+			e.ReplyMarkup = &kb
+		}
+		a.outbox <- e
+		a.forgetNotice(ref)
+	}
+}
+
+type postRef struct {
+	PostID  string
+	Account string
+	Host    string
+	Time    int64 // когда отправлено сообщение; старые записи удаляет PruneRecords
+}
+
+// PostByMessage возвращает ID поста, о котором было сообщение messageID, и аккаунт-получатель с его инстансом
+func (a *App) PostByMessage(chatID int64, messageID int) (postID, account, host string) {
+	a.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(PostMessagesBucket).Get(msgKey(chatID, messageID))
+		ref := new(postRef)
+		if len(data) > 0 && data[0] != '{' {
+			// старый формат: только ID поста
+			ref.PostID = string(data)
+		} else if data != nil {
+			json.Unmarshal(data, ref)
+		}
+		postID, account, host = ref.PostID, ref.Account, ref.Host
+		return nil
+	})
+	if host == "" {
+		host = a.apiHost
+	}
+	return
+}
+
+// switchToMessageAccount делает активным аккаунт, которому было адресовано сообщение messageID
+func (a *App) switchToMessageAccount(state *State, chatID int64, messageID int) {
+	_, account, host := a.PostByMessage(chatID, messageID)
+	if account == "" || state.User == nil || state.IsActive(&frf.User{Name: account, Host: host}) {
+		return
+	}
+	if state.UseAccount(host, account) {
+		a.SaveState(state)
+		a.SendText(state.UserID, "Переключаюсь на аккаунт "+account+".")
+	}
+}
+
+func (a *App) IsMuted(userID TgUserID, postID string) (muted bool) {
+	a.db.View(func(tx *bolt.Tx) error {
+		muted = tx.Bucket(MutedBucket).Get(muteKey(userID, postID)) != nil
+		return nil
+	})
+	return
+}
+
+func (a *App) SetMuted(userID TgUserID, postID string, muted bool) {
+	a.db.Update(func(tx *bolt.Tx) error {
+		if muted {
+			return tx.Bucket(MutedBucket).Put(muteKey(userID, postID), []byte{})
+		}
+		return tx.Bucket(MutedBucket).Delete(muteKey(userID, postID))
+	})
+}
+
+func msgKey(chatID int64, messageID int) []byte {
+	return []byte(strconv.FormatInt(chatID, 10) + ":" + strconv.Itoa(messageID))
+}
+
+func noticeKey(postID, commentID string, chatID int64, messageID int) []byte {
+	return []byte(postID + "/" + commentID + "/" + strconv.FormatInt(chatID, 10) + "/" + strconv.Itoa(messageID))
+}
+
+func muteKey(userID TgUserID, postID string) []byte {
+	return []byte(strconv.FormatInt(userID, 10) + ":" + postID)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/davidmz/FreefeedDirectBot/frf"
+)
+
+// Операции — обработка обновлений от пользователя. Пока операция идёт, её запросы к FreeFeed
+// можно прервать командой /cancel.
+
+type operations struct {
+	lk   sync.Mutex
+	byID map[TgUserID]map[context.Context]context.CancelFunc
+}
+
+type ownerKey struct{}
+
+// withOwner отмечает, что запросы к FreeFeed в контексте ctx выполняются с аккаунтами пользователя userID
+func withOwner(ctx context.Context, userID TgUserID) context.Context {
+	return context.WithValue(ctx, ownerKey{}, userID)
+}
+
+// ownerOf возвращает пользователя, с аккаунтами которого выполняются запросы в контексте ctx
+func ownerOf(ctx context.Context) (TgUserID, bool) {
+	userID, ok := ctx.Value(ownerKey{}).(TgUserID)
+	return userID, ok
+}
+
+// startOperation возвращает контекст операции пользователя userID; done нужно вызвать по её окончании
+func (a *App) startOperation(userID TgUserID) (ctx context.Context, done func()) {
+	ctx, cancel := context.WithCancel(withOwner(context.Background(), userID))
+
+	a.ops.lk.Lock()
+	if a.ops.byID == nil {
+		a.ops.byID = make(map[TgUserID]map[context.Context]context.CancelFunc)
+	}
+	if a.ops.byID[userID] == nil {
+		a.ops.byID[userID] = make(map[context.Context]context.CancelFunc)
+	}
+	a.ops.byID[userID][ctx] = cancel
+	a.ops.lk.Unlock()
+
+	return ctx, func() {
+		a.ops.lk.Lock()
+		delete(a.ops.byID[userID], ctx)
+		if len(a.ops.byID[userID]) == 0 {
+			delete(a.ops.byID, userID)
+		}
+		a.ops.lk.Unlock()
+		cancel()
+	}
+}
+
+// cancelOperations прерывает все операции пользователя, кроме текущей (current),
+// и возвращает их количество
+func (a *App) cancelOperations(userID TgUserID, current context.Context) int {
+	a.ops.lk.Lock()
+	defer a.ops.lk.Unlock()
+	n := 0
+	for ctx, cancel := range a.ops.byID[userID] {
+		if ctx != current {
+			cancel()
+			n++
+		}
+	}
+	return n
+}
+
+// errText описывает ошибку для пользователя
+func errText(err error) string {
+	switch {
+	case errors.Is(err, frf.ErrTimeout):
+		return "сервер не отвечает, попробуйте позже."
+	case errors.Is(err, context.Canceled):
+		return "операция отменена."
+	}
+	return err.Error()
+}
+
+// SendError сообщает пользователю об ошибке; format содержит %s на месте её описания.
+// Об ошибках прерванных операций не сообщается: пользователь сам их отменил.
+func (a *App) SendError(chatID TgUserID, format string, err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	a.SendText(chatID, fmt.Sprintf(format, errText(err)))
+}
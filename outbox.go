@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Telegram ограничивает длину сообщения 4096 символами (в UTF-16), берём с запасом
+const (
+	maxMessageLen = 4000
+	partLabelLen  = 16 // место под номер части
+)
+
+// splitOutgoing разбивает слишком длинное сообщение на несколько. Кнопки и привязка
+// к посту остаются только у последней части, на неё же работает ответ (Reply);
+// уведомление запоминается для каждой части, чтобы потом обновить их все.
+func splitOutgoing(msg tgbotapi.Chattable) []tgbotapi.Chattable {
+	switch m := msg.(type) {
+	case tgbotapi.MessageConfig:
+		parts := splitText(m.Text, maxMessageLen-partLabelLen)
+		if len(parts) == 1 {
+			return []tgbotapi.Chattable{m}
+		}
+		out := make([]tgbotapi.Chattable, len(parts))
+		for i, p := range parts {
+			out[i] = messagePart(m, p, i, len(parts))
+		}
+		return out
+
+	case postMessage:
+		parts := splitText(m.Text, maxMessageLen-partLabelLen)
+		if len(parts) == 1 {
+			return []tgbotapi.Chattable{m}
+		}
+		out := make([]tgbotapi.Chattable, len(parts))
+		for i, p := range parts {
+			part := m
+			part.MessageConfig = messagePart(m.MessageConfig, p, i, len(parts))
+			if m.Notice != nil {
+				n := *m.Notice
+				n.Part, n.Parts = i+1, len(parts)
+				part.Notice = &n
+			}
+			switch {
+			case i == len(parts)-1:
+				part.ReplyMarkup = m.ReplyMarkup
+				out[i] = part
+			case part.Notice != nil:
+				part.PostID, part.Sent = "", nil
+				out[i] = part
+			default:
+				out[i] = part.MessageConfig
+			}
+		}
+		return out
+
+	case tgbotapi.EditMessageTextConfig:
+		// отредактированное сообщение на части не разобьёшь, поэтому сокращаем
+		m.Text = shorten(m.Text, maxMessageLen, "")
+		return []tgbotapi.Chattable{m}
+	}
+
+	return []tgbotapi.Chattable{msg}
+}
+
+func messagePart(m tgbotapi.MessageConfig, text string, i, n int) tgbotapi.MessageConfig {
+	part := tgbotapi.NewMessage(m.ChatID, text+fmt.Sprintf("\n(%d/%d)", i+1, n))
+	part.DisableWebPagePreview = m.DisableWebPagePreview
+	part.ParseMode = m.ParseMode
+	if i > 0 {
+		part.DisableNotification = true
+	}
+	return part
+}
+
+// Telegram считает длину сообщения в единицах UTF-16: символы вне BMP (например, многие эмодзи)
+// занимают по две
+
+func utf16RuneLen(r rune) int {
+	if r > 0xFFFF {
+		return 2
+	}
+	return 1
+}
+
+func utf16Len(runes []rune) (n int) {
+	for _, r := range runes {
+		n += utf16RuneLen(r)
+	}
+	return
+}
+
+// fitUTF16 возвращает, сколько первых символов runes помещается в limit единиц UTF-16
+func fitUTF16(runes []rune, limit int) int {
+	n := 0
+	for i, r := range runes {
+		if n += utf16RuneLen(r); n > limit {
+			return i
+		}
+	}
+	return len(runes)
+}
+
+// shortenedMark заканчивает текст, который пришлось сократить
+const shortenedMark = "…\n✂️ текст сокращён"
+
+// shorten сокращает text так, чтобы вместе с tail он уместился в limit единиц UTF-16
+func shorten(text string, limit int, tail string) string {
+	runes := []rune(text)
+	tailLen := utf16Len([]rune(tail))
+	if utf16Len(runes)+tailLen <= limit {
+		return text + tail
+	}
+	keep := fitUTF16(runes, limit-tailLen-utf16Len([]rune(shortenedMark)))
+	return strings.TrimRight(string(runes[:keep]), " \n") + shortenedMark + tail
+}
+
+// splitText режет текст на куски не длиннее limit (в единицах UTF-16),
+// по возможности по границам абзацев, строк или слов
+func splitText(text string, limit int) (parts []string) {
+	runes := []rune(text)
+	for utf16Len(runes) > limit {
+		fit := fitUTF16(runes, limit)
+		chunk := string(runes[:fit])
+		cut := -1
+		for _, sep := range []string{"\n\n", "\n", " "} {
+			// не режем слишком близко к началу, чтобы не плодить крошечные части
+			if i := strings.LastIndex(chunk, sep); i > len(chunk)/2 {
+				cut = utf8.RuneCountInString(chunk[:i])
+				break
+			}
+		}
+		if cut < 0 {
+			cut = fit
+		}
+		parts = append(parts, strings.TrimRight(string(runes[:cut]), " \n"))
+		runes = []rune(strings.TrimLeft(string(runes[cut:]), " \n"))
+	}
+	return append(parts, string(runes))
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+func TestShorten(t *testing.T) {
+	if got := shorten("коротко", 20, "!"); got != "коротко!" {
+		t.Errorf("short text is changed: %q", got)
+	}
+	long := strings.Repeat("😀", maxMessageLen)
+	got := shorten(long, maxMessageLen, "\n✏️ изменено")
+	if n := utf16Len([]rune(got)); n > maxMessageLen {
+		t.Errorf("shortened text is %d UTF-16 units long", n)
+	}
+	if !strings.HasSuffix(got, shortenedMark+"\n✏️ изменено") {
+		t.Errorf("shortened text is not marked: %q", got[len(got)-60:])
+	}
+}
+
+func TestUTF16Len(t *testing.T) {
+	for _, c := range []struct {
+		text string
+		len  int
+		fit3 int // сколько символов помещается в 3 единицы
+	}{
+		{"", 0, 0},
+		{"abc", 3, 3},
+		{"юникод", 6, 3},
+		{"😀", 2, 1},
+		{"a😀b", 4, 2},
+		{"ab😀", 4, 2},
+	} {
+		runes := []rune(c.text)
+		if n := utf16Len(runes); n != c.len {
+			t.Errorf("utf16Len(%q) = %d, want %d", c.text, n, c.len)
+		}
+		if n := fitUTF16(runes, 3); n != c.fit3 {
+			t.Errorf("fitUTF16(%q, 3) = %d, want %d", c.text, n, c.fit3)
+		}
+	}
+}
+
+func TestSplitText(t *testing.T) {
+	const limit = 20
+	for _, c := range []struct {
+		name  string
+		text  string
+		parts []string
+	}{
+		{"short", "Привет", []string{"Привет"}},
+		{"exactly the limit", strings.Repeat("a", limit), []string{strings.Repeat("a", limit)}},
+		{"one over the limit", strings.Repeat("a", limit+1), []string{strings.Repeat("a", limit), "a"}},
+		{"surrogate pair at the boundary", strings.Repeat("a", limit-1) + "😀b", []string{strings.Repeat("a", limit-1), "😀b"}},
+		{"emoji only", strings.Repeat("😀", limit), []string{strings.Repeat("😀", limit/2), strings.Repeat("😀", limit/2)}},
+		{"prefers words", "one two three four five six", []string{"one two three four", "five six"}},
+		{"prefers a newline", "one two three\nfour five six", []string{"one two three", "four five six"}},
+		{"prefers a paragraph", "one two three\n\nfour\nfive six", []string{"one two three", "four\nfive six"}},
+		{"no tiny parts", "a " + strings.Repeat("b", limit), []string{"a " + strings.Repeat("b", limit-2), "bb"}},
+	} {
+		parts := splitText(c.text, limit)
+		if strings.Join(parts, "|") != strings.Join(c.parts, "|") {
+			t.Errorf("%s: splitText = %q, want %q", c.name, parts, c.parts)
+		}
+		for _, p := range parts {
+			if n := utf16Len([]rune(p)); n > limit {
+				t.Errorf("%s: part %q is %d units long", c.name, p, n)
+			}
+		}
+	}
+}
+
+func TestSplitOutgoingFitsLabels(t *testing.T) {
+	// столько частей, что номер части трёхзначный
+	text := strings.Repeat("😀", 100*maxMessageLen/2)
+	parts := splitOutgoing(tgbotapi.NewMessage(1, text))
+	if len(parts) < 100 {
+		t.Fatalf("only %d parts", len(parts))
+	}
+	if n := utf16Len([]rune(fmt.Sprintf("\n(%d/%d)", len(parts), len(parts)))); n > partLabelLen {
+		t.Errorf("part label is %d units long, more than partLabelLen", n)
+	}
+	for i, p := range parts {
+		m := p.(tgbotapi.MessageConfig)
+		if n := utf16Len([]rune(m.Text)); n > maxMessageLen {
+			t.Errorf("part %d is %d units long", i+1, n)
+		}
+		if want := fmt.Sprintf("(%d/%d)", i+1, len(parts)); !strings.HasSuffix(m.Text, want) {
+			t.Errorf("part %d is not labelled %s", i+1, want)
+		}
+	}
+}
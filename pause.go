@@ -0,0 +1,33 @@
+package main
+
+import "log"
+
+// PauseUser отключает realtime-соединения пользователя, заблокировавшего бота, кроме тех,
+// через которые идут комментарии в привязанные им группы.
+// Токены сохраняются, так что после /start ничего вводить заново не нужно.
+func (a *App) PauseUser(userID TgUserID) {
+	state := a.LoadState(userID)
+	if !state.IsAuthorized() || state.Paused {
+		return
+	}
+	state.Paused = true
+	a.SaveState(state)
+	for _, u := range state.Accounts {
+		if !a.ownsGroups(userID, u) {
+			a.StopRT(userID, u)
+		}
+	}
+	log.Println("User", userID, "blocked the bot, notifications paused")
+}
+
+// ResumeUser снова включает уведомления для вернувшегося пользователя
+func (a *App) ResumeUser(state *State) {
+	state.Paused = false
+	a.SaveState(state)
+	for _, u := range state.Accounts {
+		if !u.Invalid {
+			a.StartRT(state.UserID, u)
+		}
+	}
+	log.Println("User", state.UserID, "is back, notifications resumed")
+}
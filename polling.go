@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/davidmz/FreefeedDirectBot/frf"
+)
+
+// Realtime-соединение авторизуется токеном одного аккаунта, поэтому соединений не меньше,
+// чем аккаунтов. Чтобы их число не росло без предела, соединений открывается не больше
+// App.rtLimit, а остальные аккаунты по очереди опрашиваются одним общим циклом: раз
+// в pollInterval для каждого загружается лента директов и присылается всё новое, как
+// после разрыва соединения. Когда соединение освобождается, его получает опрашиваемый аккаунт.
+
+const pollInterval = 5 * time.Minute
+
+type polledAccount struct {
+	key  rtKey
+	user *frf.User
+}
+
+// addPolled ставит подписку в очередь опроса. Вызывается под rtLk.
+func (a *App) addPolled(key rtKey, user *frf.User) {
+	a.polled = append(a.polled, &polledAccount{key, user})
+}
+
+// removePolled убирает подписку из очереди опроса. Вызывается под rtLk.
+func (a *App) removePolled(key rtKey) {
+	for i, p := range a.polled {
+		if p.key == key {
+			a.polled = append(a.polled[:i:i], a.polled[i+1:]...)
+			if a.pollNext > i {
+				a.pollNext--
+			}
+			return
+		}
+	}
+}
+
+// promotePolled переводит опрашиваемые подписки на освободившиеся соединения. Вызывается под rtLk.
+func (a *App) promotePolled() {
+	for len(a.polled) > 0 && !a.rtFull() {
+		ck := connKey(a, a.polled[0].user)
+		// открываем соединение и подписываем на него всех, кто ждёт этот же аккаунт
+		for _, p := range append([]*polledAccount(nil), a.polled...) {
+			if connKey(a, p.user) == ck {
+				a.removePolled(p.key)
+				a.subscribeRT(p.key, p.user)
+			}
+		}
+	}
+}
+
+// nextPolled возвращает следующую по кругу опрашиваемую подписку и их общее число
+func (a *App) nextPolled() (*polledAccount, int) {
+	a.rtLk.Lock()
+	defer a.rtLk.Unlock()
+	if len(a.polled) == 0 {
+		return nil, 0
+	}
+	if a.pollNext >= len(a.polled) {
+		a.pollNext = 0
+	}
+	p := a.polled[a.pollNext]
+	a.pollNext++
+	return p, len(a.polled)
+}
+
+// RunPolling опрашивает подписки, которым не хватило соединений. Не возвращается.
+func (a *App) RunPolling() {
+	for {
+		p, n := a.nextPolled()
+		if p == nil {
+			time.Sleep(pollInterval)
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), pollInterval)
+		a.CatchUp(ctx, p.key.UserID, p.user, a.Watermark(p.key.UserID, p.user))
+		cancel()
+		// так каждая подписка опрашивается примерно раз в pollInterval
+		time.Sleep(pollInterval / time.Duration(n))
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Записи о сообщениях Telegram нужны, пока на эти сообщения отвечают. Чтобы база не росла
+// бесконечно, при запуске бот забывает записи старше заданного срока.
+
+// prunedBuckets — бакеты, значения которых — JSON-объекты с полем Time (unix-время записи)
+var prunedBuckets = [][]byte{
+	PostMessagesBucket,
+	SentMessagesBucket,
+	NoticesBucket,
+}
+
+// PruneRecords удаляет записи о сообщениях, сделанные раньше before, и возвращает их число.
+// Записям без времени (сделанным до того, как его стали сохранять) ставится текущее время.
+func (a *App) PruneRecords(before time.Time) (n int, err error) {
+	now := time.Now().Unix()
+	err = a.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range prunedBuckets {
+			b := tx.Bucket(name)
+			var (
+				expired [][]byte
+				stamped = map[string][]byte{}
+			)
+			b.ForEach(func(k, v []byte) error {
+				rec := map[string]interface{}{}
+				if len(v) > 0 && v[0] != '{' {
+					// старый формат PostMessages: только ID поста
+					rec["PostID"] = string(v)
+				} else if json.Unmarshal(v, &rec) != nil {
+					expired = append(expired, k)
+					return nil
+				}
+				if t, ok := rec["Time"].(float64); !ok {
+					rec["Time"] = now
+					stamped[string(k)], _ = json.Marshal(rec)
+				} else if int64(t) < before.Unix() {
+					expired = append(expired, k)
+				}
+				return nil
+			})
+			// менять бакет внутри ForEach нельзя
+			for _, k := range expired {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+			}
+			for k, v := range stamped {
+				if err := b.Put([]byte(k), v); err != nil {
+					return err
+				}
+			}
+			n += len(expired)
+		}
+		return nil
+	})
+	return
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestPruneRecords(t *testing.T) {
+	e := newTestEnv(t)
+	old, fresh := time.Now().AddDate(0, 0, -100).Unix(), time.Now().Unix()
+	put := func(bucket []byte, key string, v interface{}) {
+		data, ok := v.([]byte)
+		if !ok {
+			data, _ = json.Marshal(v)
+		}
+		e.app.db.Update(func(tx *bolt.Tx) error { return tx.Bucket(bucket).Put([]byte(key), data) })
+	}
+	put(PostMessagesBucket, "old", &postRef{PostID: "p1", Time: old})
+	put(PostMessagesBucket, "fresh", &postRef{PostID: "p2", Time: fresh})
+	put(PostMessagesBucket, "legacy", []byte("p3"))
+	put(SentMessagesBucket, "old", &sentItem{PostID: "p1", Time: old})
+	put(SentMessagesBucket, "fresh", &sentItem{PostID: "p2", Time: fresh})
+	put(NoticesBucket, string(noticeKey("p1", "", alice, 1)), &notice{Header: "old", Time: old})
+	put(NoticesBucket, string(noticeKey("p2", "", alice, 2)), &notice{Header: "fresh", Time: fresh})
+
+	n, err := e.app.PruneRecords(time.Now().AddDate(0, 0, -90))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("pruned %d records, want 3", n)
+	}
+	e.app.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(PostMessagesBucket)
+		if b.Get([]byte("old")) != nil || b.Get([]byte("fresh")) == nil {
+			t.Error("wrong PostMessages records are pruned")
+		}
+		b = tx.Bucket(SentMessagesBucket)
+		if b.Get([]byte("old")) != nil || b.Get([]byte("fresh")) == nil {
+			t.Error("wrong SentMessages records are pruned")
+		}
+		ref := new(postRef)
+		if err := json.Unmarshal(tx.Bucket(PostMessagesBucket).Get([]byte("legacy")), ref); err != nil || ref.PostID != "p3" || ref.Time == 0 {
+			t.Errorf("legacy record is not stamped: %+v, %v", ref, err)
+		}
+		return nil
+	})
+	if len(e.app.findNotices(alice, "p1", "", false)) != 0 || len(e.app.findNotices(alice, "p2", "", false)) != 1 {
+		t.Error("wrong Notices records are pruned")
+	}
+}
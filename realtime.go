@@ -1,15 +1,19 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"log"
+	"math/rand"
+	"net/http"
 	"net/url"
-	"strconv"
+	"sync"
 	"time"
 
 	"github.com/boltdb/bolt"
 	"github.com/davidmz/FreefeedDirectBot/frf"
-	"github.com/gorilla/websocket"
+	"github.com/davidmz/FreefeedDirectBot/socketio"
 )
 
 func (a *App) LoadRT() {
@@ -17,7 +21,11 @@ func (a *App) LoadRT() {
 	a.db.View(func(tx *bolt.Tx) error {
 		tx.Bucket(StatesBucket).ForEach(func(k, v []byte) error {
 			s := new(State)
-			json.Unmarshal(v, s)
+			if err := decodeState(v, s, a.keys); err != nil {
+				log.Println("Can not decode state", string(k), err)
+				return nil
+			}
+			s.setDefaultHost(a.apiHost)
 			if s.User != nil {
 				states = append(states, s.Clone(ActNothing))
 			}
@@ -27,132 +35,407 @@ func (a *App) LoadRT() {
 	})
 
 	for _, s := range states {
-		a.StartRT(s)
+		for _, u := range s.Accounts {
+			// у заблокировавших бота соединения нужны только для привязанных групп
+			if !u.Invalid && (!s.Paused || a.ownsGroups(s.UserID, u)) {
+				a.StartRT(s.UserID, u)
+			}
+		}
 	}
 }
 
-func (a *App) StartRT(s *State) {
+// rtKey — подписка аккаунта Account пользователя Telegram UserID на уведомления
+type rtKey struct {
+	UserID  TgUserID
+	Host    string
+	Account string
+}
+
+// Realtime-сервер FreeFeed авторизует всё соединение одним токеном, а лента директов видна
+// только её владельцу, поэтому соединения разных аккаунтов FreeFeed объединить нельзя.
+// Но если один аккаунт подключили несколько пользователей Telegram (или один пользователь
+// подключил его дважды), они используют одно общее соединение. Сверх App.rtLimit
+// соединений аккаунты не подключаются, а опрашиваются (см. polling.go).
+func connKey(a *App, user *frf.User) string { return a.hostOf(user) + "\x00" + user.AccessToken }
+
+// Не больше стольких одновременных попыток подключения (при запуске и после перезапуска сервера)
+const maxConcurrentDials = 8
+
+func (a *App) StartRT(userID TgUserID, user *frf.User) {
+	key := rtKey{userID, a.hostOf(user), user.Name}
 	a.rtLk.Lock()
-	a.rts[s.UserID] = NewRealtime(a, s)
-	a.rtLk.Unlock()
+	defer a.rtLk.Unlock()
+
+	if r, ok := a.rts[key]; ok {
+		// например, у аккаунта обновился токен
+		a.unsubscribe(key, r)
+	}
+	a.removePolled(key)
+	a.subscribeRT(key, user)
+}
+
+// rtFull сообщает, что открыто предельное число соединений. Вызывается под rtLk.
+func (a *App) rtFull() bool { return a.rtLimit > 0 && len(a.conns) >= a.rtLimit }
+
+// subscribeRT подписывает key на общее соединение аккаунта user, а если его нет и открывать
+// новые уже нельзя — ставит в очередь опроса. Вызывается под rtLk.
+func (a *App) subscribeRT(key rtKey, user *frf.User) {
+	userID := key.UserID
+	r, ok := a.conns[connKey(a, user)]
+	if !ok {
+		if a.rtFull() {
+			a.addPolled(key, user)
+			return
+		}
+		r = NewRealtime(a, user)
+		a.conns[connKey(a, user)] = r
+	}
+	a.rts[key] = r
+	// события начнут приходить подписчику сразу, поэтому водяной знак берём заранее
+	since := a.Watermark(userID, user)
+	if r.addSubscriber(key, since) {
+		// соединение уже подписано, догоняем только для нового подписчика
+		go a.CatchUp(r.ctx, userID, user, since)
+	}
 }
 
-func (a *App) StopRT(s *State) {
+func (a *App) StopRT(userID TgUserID, user *frf.User) {
+	key := rtKey{userID, a.hostOf(user), user.Name}
 	a.rtLk.Lock()
-	if r, ok := a.rts[s.UserID]; ok {
+	defer a.rtLk.Unlock()
+	if r, ok := a.rts[key]; ok {
+		a.unsubscribe(key, r)
+	}
+	a.removePolled(key)
+}
+
+// unsubscribe отписывает key от соединения и закрывает соединение, если подписчиков не осталось.
+// Вызывается под rtLk.
+func (a *App) unsubscribe(key rtKey, r *Realtime) {
+	delete(a.rts, key)
+	if r.removeSubscriber(key) == 0 {
 		r.Close()
-		delete(a.rts, s.UserID)
+		if a.conns[connKey(a, r.User)] == r {
+			delete(a.conns, connKey(a, r.User))
+			a.promotePolled()
+		}
 	}
-	a.rtLk.Unlock()
 }
 
 type Realtime struct {
 	App     *App
-	UserID  TgUserID
-	User    *frf.User
+	User    *frf.User // аккаунт, токеном которого авторизовано соединение
 	closeCh chan struct{}
+	ctx     context.Context // отменяется при закрытии соединения
+	cancel  context.CancelFunc
+
+	closeOnce sync.Once
+	lk        sync.Mutex
+	health    RTHealth
+	// подписчики и их водяные знаки на момент, с которого им начали приходить события:
+	// догонять нужно от них, а не от текущих, которые события уже могли сдвинуть
+	subscribers map[rtKey]int64
 }
 
-func NewRealtime(a *App, s *State) *Realtime {
+type RTStatus string
+
+const (
+	RTConnecting   RTStatus = "connecting"
+	RTConnected    RTStatus = "connected"
+	RTWaiting      RTStatus = "waiting" // ждём перед повторным подключением
+	RTPolling      RTStatus = "polling" // соединений не хватило, ленту опрашиваем
+	RTUnauthorized RTStatus = "unauthorized"
+	RTStopped      RTStatus = "stopped"
+)
+
+var rtStatusTitles = map[RTStatus]string{
+	RTConnecting:   "подключаюсь к серверу",
+	RTConnected:    "на связи",
+	RTWaiting:      "нет связи с сервером, скоро попробую снова",
+	RTPolling:      "проверяю новые директы раз в несколько минут",
+	RTUnauthorized: "токен не действует",
+	RTStopped:      "уведомления отключены",
+}
+
+// RTHealth — состояние realtime-соединения
+type RTHealth struct {
+	Status       RTStatus
+	Since        time.Time
+	Failures     int // неудачных попыток подключения подряд
+	LastError    string
+	Subscription SubStatus
+	Subscribers  int // сколько подписок обслуживает соединение
+}
+
+type SubStatus string
+
+const (
+	SubPending   SubStatus = "pending"   // запрос подписки отправлен, ответа ещё нет
+	SubConfirmed SubStatus = "confirmed" // сервер подтвердил подписку
+	SubRejected  SubStatus = "rejected"  // сервер отказал в подписке
+)
+
+const (
+	maxRTDelay = 5 * time.Minute
+	// после разрыва работавшего соединения (обычно это перезапуск сервера) переподключаемся
+	// в случайный момент этого интервала, чтобы не обрушиться на сервер всем скопом
+	reconnectSpread = 30 * time.Second
+	// работавшим считается соединение, продержавшееся хотя бы столько; если соединение
+	// рвётся быстрее, задержка перед переподключением растёт, как после неудачных попыток
+	minStableSession = time.Minute
+)
+
+var errRTUnauthorized = errors.New("Realtime server rejected the access token")
+
+func NewRealtime(a *App, user *frf.User) *Realtime {
 	rt := &Realtime{
-		App:     a,
-		UserID:  s.UserID,
-		User:    s.User,
-		closeCh: make(chan struct{}, 0),
+		App:         a,
+		User:        user,
+		closeCh:     make(chan struct{}, 0),
+		subscribers: make(map[rtKey]int64),
 	}
+	rt.ctx, rt.cancel = context.WithCancel(context.Background())
+	rt.setStatus(RTConnecting, nil)
 	go rt.run()
 	return rt
 }
 
+func (r *Realtime) Health() RTHealth {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	h := r.health
+	h.Subscribers = len(r.subscribers)
+	return h
+}
+
+// addSubscriber добавляет подписчика с водяным знаком since и сообщает, подписано ли уже соединение
+func (r *Realtime) addSubscriber(key rtKey, since int64) bool {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	r.subscribers[key] = since
+	return r.health.Subscription == SubConfirmed
+}
+
+// captureWatermarks запоминает водяные знаки подписчиков перед отправкой запроса подписки
+func (r *Realtime) captureWatermarks() {
+	for _, key := range r.subscriberList() {
+		since := r.App.Watermark(key.UserID, &frf.User{Host: key.Host, Name: key.Account})
+		r.lk.Lock()
+		if _, ok := r.subscribers[key]; ok {
+			r.subscribers[key] = since
+		}
+		r.lk.Unlock()
+	}
+}
+
+func (r *Realtime) removeSubscriber(key rtKey) int {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	delete(r.subscribers, key)
+	return len(r.subscribers)
+}
+
+func (r *Realtime) subscriberList() []rtKey {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	keys := make([]rtKey, 0, len(r.subscribers))
+	for key := range r.subscribers {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (r *Realtime) setSubscription(status SubStatus) {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	r.health.Subscription = status
+}
+
+func (r *Realtime) setStatus(status RTStatus, err error) {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	if r.health.Status != status {
+		r.health.Status = status
+		r.health.Since = time.Now()
+	}
+	switch {
+	case status == RTConnected:
+		r.health.LastError = ""
+	case err != nil:
+		r.health.LastError = err.Error()
+	}
+}
+
+func (r *Realtime) resetFailures() {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	r.health.Failures = 0
+}
+
+func (r *Realtime) fail(err error) int {
+	r.lk.Lock()
+	r.health.Failures++
+	failures := r.health.Failures
+	r.lk.Unlock()
+	r.setStatus(RTWaiting, err)
+	return failures
+}
+
+func (r *Realtime) closed() bool {
+	select {
+	case <-r.closeCh:
+		return true
+	default:
+		return false
+	}
+}
+
 func (r *Realtime) run() {
-	var (
-		conn *websocket.Conn
-		err  error
-	)
-	go func() {
-		<-r.closeCh
-		conn.Close()
-	}()
-loop:
 	for {
-
+		err := r.session()
+		if r.closed() {
+			r.setStatus(RTStopped, nil)
+			return
+		}
+		if err == errRTUnauthorized {
+			r.setStatus(RTUnauthorized, err)
+			for _, key := range r.subscriberList() {
+				r.App.AuthFailed(key.UserID, r.User)
+			}
+			return
+		}
+		h := r.Health()
+		stable := h.Status == RTConnected && time.Since(h.Since) >= minStableSession
+		if stable {
+			r.resetFailures()
+		}
+		delay := backoff(r.fail(err), maxRTDelay)
+		if stable {
+			delay = time.Duration(rand.Int63n(int64(reconnectSpread)))
+		}
+		log.Println("Realtime of", r.User.Name, "failed:", err, "- reconnecting in", delay)
 		select {
 		case <-r.closeCh:
-			break loop
-		default:
+			r.setStatus(RTStopped, nil)
+			return
+		case <-time.After(delay):
 		}
+	}
+}
 
-		conn, _, err = websocket.DefaultDialer.Dial(
-			"wss://"+r.App.apiHost+"/socket.io/?token="+url.QueryEscape(r.User.AccessToken)+"&EIO=3&transport=websocket",
-			nil,
-		)
-		if err != nil {
-			log.Println("Can not connect to websocket:", err)
-			time.Sleep(10 * time.Second)
-			continue
+// session держит одно соединение, пока оно не оборвётся или не будет закрыто
+func (r *Realtime) session() error {
+	r.setStatus(RTConnecting, nil)
+	r.setSubscription(SubPending)
+	select {
+	case r.App.dialSem <- struct{}{}:
+	case <-r.closeCh:
+		return nil
+	}
+	host := r.App.hostOf(r.User)
+	client, err := socketio.DialWith(r.App.wsDialer(host), r.App.rtURL(host)+"/socket.io/?token="+url.QueryEscape(r.User.AccessToken), nil)
+	<-r.App.dialSem
+	if err != nil {
+		if he, ok := err.(*socketio.HandshakeError); ok &&
+			(he.StatusCode == http.StatusUnauthorized || he.StatusCode == http.StatusForbidden) {
+			return errRTUnauthorized
 		}
+		return err
+	}
 
-		conn.WriteMessage(websocket.TextMessage, []byte(`42["subscribe",{"timeline":["`+r.User.DirectFeed+`"]}]`))
+	// done закрывается вместе с соединением и останавливает все его горутины
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-r.closeCh:
+		case <-done:
+		}
+		client.Close()
+	}()
 
-		for {
+	client.OnOpen(func(socketio.Handshake) {
+		r.setStatus(RTConnected, nil)
+		// старые версии сервера не подтверждают подписку, для них догоняем по таймауту
+		go func() {
 			select {
-			case <-r.closeCh:
-				break loop
-			default:
-			}
-
-			_, p, err := conn.ReadMessage()
-			if err != nil {
-				log.Print("Error: ", err)
-				break
-			}
-			t, p := msgSplit(p)
-			if t == 0 {
-				// start
-				v := &struct {
-					PingInterval int `json:"pingInterval"`
-				}{}
-				if err := json.Unmarshal(p, v); err != nil {
-					log.Print("Error: ", err)
-					break
-				}
-				go pingCycle(conn, time.Duration(v.PingInterval)*time.Millisecond)
-			} else if t == 42 {
-				v := []json.RawMessage{}
-				if err := json.Unmarshal(p, &v); err != nil {
-					log.Print("Error: ", err)
-					break
+			case <-done:
+			case <-time.After(subscribeAckTimeout):
+				if r.Health().Subscription == SubPending {
+					r.catchUp()
 				}
-				// log.Println("Event:", string(v[0]), string(v[1]))
-				r.App.HandleRT(r.UserID, string(v[0]), v[1])
 			}
+		}()
+	})
+	client.OnAny(func(event string, args []json.RawMessage) {
+		if len(args) == 0 {
+			return
+		}
+		for _, key := range r.subscriberList() {
+			r.App.HandleRT(r.ctx, key, event, args[0])
 		}
+	})
+
+	// все ленты подписываются одним запросом
+	r.captureWatermarks()
+	if err := client.EmitAck("subscribe", r.onSubscribeAck, map[string][]string{"timeline": {r.User.DirectFeed}}); err != nil {
+		client.Close()
+		return err
 	}
+	return client.Run()
 }
 
-func (r *Realtime) Close() { close(r.closeCh) }
+const subscribeAckTimeout = 10 * time.Second
 
-func msgSplit(p []byte) (int, []byte) {
-	cut := len(p)
-	for i, b := range p {
-		if b < 0x30 || b > 0x39 { // not a digit
-			cut = i
-			break
-		}
+// onSubscribeAck разбирает ответ на подписку. Старые версии сервера не отвечают вовсе,
+// тогда подписка так и остаётся в состоянии SubPending, но события всё равно приходят.
+func (r *Realtime) onSubscribeAck(args []json.RawMessage) {
+	v := &struct {
+		Success *bool  `json:"success"`
+		Message string `json:"message"`
+	}{}
+	if len(args) > 0 {
+		json.Unmarshal(args[0], v)
+	}
+	if v.Success != nil && !*v.Success {
+		log.Println("Realtime subscription of", r.User.Name, "is rejected:", v.Message)
+		r.setSubscription(SubRejected)
+		return
 	}
-	t, _ := strconv.Atoi(string(p[:cut]))
-	return t, p[cut:]
+	r.setSubscription(SubConfirmed)
+	r.catchUp()
 }
 
-func pingCycle(conn *websocket.Conn, interval time.Duration) {
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
-	for {
-		select {
-		case <-ticker.C:
-			if err := conn.WriteMessage(websocket.TextMessage, []byte("2")); err != nil {
-				return
-			}
+// подписка действует, так что всё новое придёт в соединение, а пропущенное догоняем
+func (r *Realtime) catchUp() {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	for key, since := range r.subscribers {
+		go r.App.CatchUp(r.ctx, key.UserID, r.User, since)
+	}
+}
+
+func (r *Realtime) Close() {
+	r.closeOnce.Do(func() {
+		close(r.closeCh)
+		r.cancel()
+	})
+}
+
+// RTHealth возвращает состояние realtime-соединений всех аккаунтов пользователя
+func (a *App) RTHealth(userID TgUserID) map[rtKey]RTHealth {
+	a.rtLk.Lock()
+	defer a.rtLk.Unlock()
+	out := make(map[rtKey]RTHealth)
+	for key, r := range a.rts {
+		if key.UserID == userID {
+			out[key] = r.Health()
+		}
+	}
+	for _, p := range a.polled {
+		if p.key.UserID == userID {
+			out[p.key] = RTHealth{Status: RTPolling}
 		}
 	}
+	return out
 }
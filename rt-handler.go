@@ -1,25 +1,40 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"log"
-	"strings"
+	"strconv"
 
 	"github.com/davidmz/FreefeedDirectBot/frf"
 )
 
-func (a *App) HandleRT(userID TgUserID, event string, jmsg json.RawMessage) {
+// HandleRT обрабатывает событие, пришедшее в realtime-соединение подписки key
+func (a *App) HandleRT(ctx context.Context, key rtKey, event string, jmsg json.RawMessage) {
+	userID := key.UserID
+	ctx = withOwner(ctx, userID)
+	defer func() {
+		if r := recover(); r != nil {
+			log.Println("Panic while handling realtime event", event, "of", userID, key.Account, ":", r)
+		}
+	}()
+
 	state := a.LoadState(userID)
-	if !state.IsAuthorized() {
+	account := state.Account(key.Host, key.Account)
+	if account == nil {
 		// нет авторизованного юзера
-		log.Println("Cannot find state", userID)
+		log.Println("Cannot find state", userID, key.Host, key.Account)
+		return
+	}
+	// пока пользователь заблокировал бота, соединение нужно только для привязанных групп
+	if state.Paused && event != "comment:new" && event != "post:destroy" {
 		return
 	}
 
-	if event == `"comment:new"` {
+	if event == "comment:new" {
 		v := new(frf.RTNewComment)
 		if err := json.Unmarshal(jmsg, v); err != nil {
-			log.Println("Can not decode:", string(jmsg[:20]))
+			log.Println("Can not decode:", head(jmsg, 20))
 			return
 		}
 
@@ -32,54 +47,136 @@ func (a *App) HandleRT(userID TgUserID, event string, jmsg json.RawMessage) {
 			}
 		}
 
-		if authorName == state.User.Name {
-			// комментарий от нас
+		createdAt, _ := strconv.ParseInt(v.Comment.CreatedAt, 10, 64)
+		comment := &frf.Comment{ID: v.Comment.ID, Body: v.Comment.Body, Author: authorName, CreatedAt: createdAt}
+
+		// в группу пересылаются и наши комментарии: остальные участники группы их не видели
+		a.forwardToGroups(userID, account, v.Comment.PostID, comment)
+		if state.Paused {
+			// уведомления догонят после /start
 			return
 		}
+		a.AdvanceWatermark(userID, account, createdAt)
 
-		cacheKey := "comm:" + state.User.Name + ":" + v.Comment.ID
-		if _, err := a.cache.Get(cacheKey); err == nil {
-			// дубль для данного слуштеля
-			log.Println("Duplicate comment for ", state.User.Name, v.Comment.ID)
+		if state.Account(account.Host, authorName) != nil || a.IsMuted(userID, v.Comment.PostID) {
+			// комментарий от нас или обсуждение заглушено
 			return
 		}
-		a.cache.Set(cacheKey, struct{}{})
 
-		post, err := a.getPostByID(state.User, v.Comment.PostID)
+		post, err := a.getPostByID(ctx, account, v.Comment.PostID)
 		if err != nil {
 			log.Println("Can not find post:", v.Comment.PostID, err)
 			return
 		}
+		a.notifyComment(state, account, post, comment)
 
-		a.SendText(userID,
-			"💬 "+authorName+" ответил на пост «"+post.ShortBody()+"»:\n"+
-				strings.Repeat("\u2500", 10)+"\n"+
-				v.Comment.Body+"\n"+
-				strings.Repeat("\u2500", 10)+"\n"+
-				"Ответить: /re_"+post.ID[:4]+" или ответить (Reply) на это сообщение\n"+
-				"Открыть: https://"+a.apiHost+"/"+post.Author+"/"+post.ID+"\n",
-		)
-
-	} else if event == `"post:new"` {
+	} else if event == "post:new" {
 		v := new(frf.OnePostResponse)
 		if err := json.Unmarshal(jmsg, v); err != nil {
-			log.Println("Can not decode:", string(jmsg[:20]))
+			log.Println("Can not decode:", head(jmsg, 20))
 			return
 		}
 
 		post := v.GetPost()
-		if post.Author == state.User.Name {
-			// комментарий от нас
+		a.AdvanceWatermark(userID, account, post.CreatedAt)
+		if state.Account(account.Host, post.Author) != nil {
+			// пост от нас
+			return
+		}
+		a.notifyPost(state, account, post)
+
+		// изменения и удаления приходят по той же подписке на ленту директов
+
+	} else if event == "post:update" {
+		v := new(frf.OnePostResponse)
+		if err := json.Unmarshal(jmsg, v); err != nil {
+			log.Println("Can not decode:", head(jmsg, 20))
+			return
+		}
+		a.UpdateNotices(userID, v.Post.ID, "", v.Post.Body)
+
+	} else if event == "comment:update" {
+		v := new(frf.RTNewComment)
+		if err := json.Unmarshal(jmsg, v); err != nil {
+			log.Println("Can not decode:", head(jmsg, 20))
+			return
+		}
+		a.UpdateNotices(userID, v.Comment.PostID, v.Comment.ID, v.Comment.Body)
+
+	} else if event == "post:destroy" {
+		v := new(frf.RTPostDestroy)
+		if err := json.Unmarshal(jmsg, v); err != nil {
+			log.Println("Can not decode:", head(jmsg, 20))
 			return
 		}
+		if !state.Paused {
+			a.DestroyNotices(userID, v.Meta.PostID, "")
+		}
+		a.unbindGroups(a.findGroups(func(g *groupBinding) bool {
+			return g.PostID == v.Meta.PostID && g.ownedBy(userID, account)
+		}), "Директ удалён.")
+
+	} else if event == "comment:destroy" {
+		v := new(frf.RTCommentDestroy)
+		if err := json.Unmarshal(jmsg, v); err != nil {
+			log.Println("Can not decode:", head(jmsg, 20))
+			return
+		}
+		a.DestroyNotices(userID, v.PostID, v.CommentID)
+	}
+}
+
+// head возвращает начало сообщения для журнала
+func head(data []byte, n int) string {
+	if len(data) > n {
+		data = data[:n]
+	}
+	return string(data)
+}
+
+// notifyComment присылает уведомление о новом комментарии, если его ещё не присылали
+func (a *App) notifyComment(state *State, account *frf.User, post *frf.Post, comment *frf.Comment) {
+	// один и тот же комментарий может прийти в соединения нескольких аккаунтов или при догоняющей загрузке
+	cacheKey := "comm:" + strconv.FormatInt(state.UserID, 10) + ":" + comment.ID
+	if _, err := a.cache.Get(cacheKey); err == nil {
+		log.Println("Duplicate comment for ", state.UserID, comment.ID)
+		return
+	}
+	a.cache.Set(cacheKey, struct{}{})
+
+	a.SendNotice(state.UserID, &notice{
+		PostID:    post.ID,
+		CommentID: comment.ID,
+		Header:    accountTag(state, account) + "💬 " + comment.Author + " ответил на пост «" + post.ShortBody() + "»:",
+		Author:    post.Author,
+		Account:   account.Name,
+		Host:      a.hostOf(account),
+	}, comment.Body)
+}
+
+// notifyPost присылает уведомление о новом посте, если его ещё не присылали
+func (a *App) notifyPost(state *State, account *frf.User, post *frf.Post) {
+	cacheKey := "post:" + strconv.FormatInt(state.UserID, 10) + ":" + post.ID
+	if _, err := a.cache.Get(cacheKey); err == nil {
+		log.Println("Duplicate post for ", state.UserID, post.ID)
+		return
+	}
+	a.cache.Set(cacheKey, struct{}{})
+
+	a.SendNotice(state.UserID, &notice{
+		PostID:  post.ID,
+		Header:  accountTag(state, account) + "📨 " + post.Author + " написал " + humanList(post.Addressees, account.Name, "вам") + ":",
+		Author:  post.Author,
+		Account: account.Name,
+		Host:    a.hostOf(account),
+	}, post.Body)
+	a.SendAttachments(state.UserID, post.Attachments)
+}
 
-		a.SendText(userID,
-			"📨 "+post.Author+" написал "+humanList(post.Addressees, state.User.Name, "вам")+":\n"+
-				strings.Repeat("\u2500", 10)+"\n"+
-				post.Body+"\n"+
-				strings.Repeat("\u2500", 10)+"\n"+
-				"Ответить: /re_"+post.ID[:4]+" или ответить (Reply) на это сообщение\n"+
-				"Открыть: https://"+a.apiHost+"/"+post.Author+"/"+post.ID+"\n",
-		)
+// accountTag помечает уведомление аккаунтом-получателем, если у пользователя их несколько
+func accountTag(state *State, account *frf.User) string {
+	if len(state.Accounts) < 2 {
+		return ""
 	}
+	return "👤 " + account.Name + "\n"
 }
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/davidmz/FreefeedDirectBot/frf"
+)
+
+// sentItem — пост или комментарий FreeFeed, созданный из сообщения Telegram
+type sentItem struct {
+	PostID    string
+	CommentID string `json:",omitempty"`
+	Account   string `json:",omitempty"` // аккаунт-автор; в старых записях не сохранён
+	Host      string `json:",omitempty"` // инстанс FreeFeed аккаунта-автора
+	Time      int64  // когда запомнено; старые записи удаляет PruneRecords
+}
+
+func (a *App) newSentItem(account *frf.User, postID, commentID string) *sentItem {
+	return &sentItem{PostID: postID, CommentID: commentID, Account: account.Name, Host: a.hostOf(account)}
+}
+
+func (s *sentItem) IsComment() bool { return s.CommentID != "" }
+
+// sentAccount возвращает аккаунт, от имени которого создан item, или nil, если он уже отключён.
+// Для старых записей без аккаунта — активный аккаунт.
+func (s *State) sentAccount(item *sentItem) *frf.User {
+	if item.Account == "" {
+		return s.User
+	}
+	return s.Account(item.Host, item.Account)
+}
+
+func (a *App) rememberSent(chatID int64, messageID int, item *sentItem) {
+	a.db.Update(func(tx *bolt.Tx) error {
+		rec := *item
+		rec.Time = time.Now().Unix()
+		data, _ := json.Marshal(&rec)
+		return tx.Bucket(SentMessagesBucket).Put(msgKey(chatID, messageID), data)
+	})
+}
+
+// sentByMessage возвращает пост или комментарий, созданный из сообщения messageID, или nil
+func (a *App) sentByMessage(chatID int64, messageID int) (item *sentItem) {
+	a.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(SentMessagesBucket).Get(msgKey(chatID, messageID))
+		if data == nil {
+			return nil
+		}
+		item = new(sentItem)
+		return json.Unmarshal(data, item)
+	})
+	return
+}
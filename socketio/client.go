@@ -0,0 +1,330 @@
+package socketio
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	ErrPongTimeout  = errors.New("Socket.io server does not answer pings")
+	ErrServerClosed = errors.New("Socket.io server closed the connection")
+	ErrClosed       = errors.New("Socket.io connection is closed")
+)
+
+// HandshakeError — сервер отказался открыть соединение (например, 401 при неверном токене)
+type HandshakeError struct {
+	StatusCode int
+	Err        error
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("socket.io handshake failed with status %d: %v", e.StatusCode, e.Err)
+}
+
+type (
+	EventHandler func(args []json.RawMessage)
+	AnyHandler   func(event string, args []json.RawMessage)
+	AckHandler   func(args []json.RawMessage)
+)
+
+// Client — соединение с сервером socket.io. Обработчики вызываются по порядку поступления
+// пакетов в отдельной горутине: пока медленный обработчик работает, Run продолжает читать
+// пакеты и понги не опаздывают.
+type Client struct {
+	conn    *websocket.Conn
+	writeLk sync.Mutex
+
+	lk       sync.Mutex
+	handlers map[string]EventHandler
+	onAny    AnyHandler
+	onOpen   func(Handshake)
+	acks     map[int]AckHandler
+	nextAck  int
+	err      error    // причина закрытия
+	queue    []func() // вызовы обработчиков, ждущие своей очереди
+
+	queued    chan struct{}
+	pongs     chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Dial открывает соединение. Параметры транспорта (EIO, transport) добавляются к rawURL сами.
+func Dial(rawURL string, header http.Header) (*Client, error) {
+	return DialWith(websocket.DefaultDialer, rawURL, header)
+}
+
+func DialWith(dialer *websocket.Dialer, rawURL string, header http.Header) (*Client, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	q.Set("EIO", "3")
+	q.Set("transport", "websocket")
+	u.RawQuery = q.Encode()
+
+	conn, resp, err := dialer.Dial(u.String(), header)
+	if err != nil {
+		if resp != nil {
+			return nil, &HandshakeError{StatusCode: resp.StatusCode, Err: err}
+		}
+		return nil, err
+	}
+	return &Client{
+		conn:     conn,
+		handlers: make(map[string]EventHandler),
+		acks:     make(map[int]AckHandler),
+		queued:   make(chan struct{}, 1),
+		pongs:    make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}, nil
+}
+
+// On задаёт обработчик события event
+func (c *Client) On(event string, h EventHandler) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	c.handlers[event] = h
+}
+
+// OnAny задаёт обработчик событий, для которых нет своего обработчика
+func (c *Client) OnAny(h AnyHandler) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	c.onAny = h
+}
+
+// OnOpen вызывается, когда сервер прислал параметры сессии
+func (c *Client) OnOpen(h func(Handshake)) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	c.onOpen = h
+}
+
+func (c *Client) Emit(event string, args ...interface{}) error {
+	p, err := NewEvent(event, NoAck, args...)
+	if err != nil {
+		return err
+	}
+	return c.write(p)
+}
+
+// EmitAck отправляет событие, на которое сервер должен ответить; ответ получит ack
+func (c *Client) EmitAck(event string, ack AckHandler, args ...interface{}) error {
+	c.lk.Lock()
+	id := c.nextAck
+	c.nextAck++
+	c.acks[id] = ack
+	c.lk.Unlock()
+
+	p, err := NewEvent(event, id, args...)
+	if err == nil {
+		err = c.write(p)
+	}
+	if err != nil {
+		c.lk.Lock()
+		delete(c.acks, id)
+		c.lk.Unlock()
+	}
+	return err
+}
+
+func (c *Client) write(p *Packet) error {
+	c.writeLk.Lock()
+	defer c.writeLk.Unlock()
+	return c.conn.WriteMessage(websocket.TextMessage, p.Encode())
+}
+
+// dispatch ставит вызов обработчика в очередь
+func (c *Client) dispatch(call func()) {
+	c.lk.Lock()
+	c.queue = append(c.queue, call)
+	c.lk.Unlock()
+	select {
+	case c.queued <- struct{}{}:
+	default:
+	}
+}
+
+// runHandlers вызывает обработчики из очереди, пока соединение не закроется
+func (c *Client) runHandlers() {
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-c.queued:
+		}
+		for {
+			c.lk.Lock()
+			if len(c.queue) == 0 {
+				c.lk.Unlock()
+				break
+			}
+			call := c.queue[0]
+			c.queue[0] = nil
+			c.queue = c.queue[1:]
+			c.lk.Unlock()
+
+			select {
+			case <-c.done:
+				return
+			default:
+			}
+			call()
+		}
+	}
+}
+
+// Run читает пакеты, пока соединение не закроется, и возвращает причину закрытия
+func (c *Client) Run() error {
+	go c.runHandlers()
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			return c.fail(err)
+		}
+		p, err := ParsePacket(data)
+		if err != nil {
+			continue
+		}
+
+		switch p.Type {
+		case Open:
+			hs := Handshake{}
+			if err := json.Unmarshal(p.Data, &hs); err != nil {
+				return c.fail(err)
+			}
+			go c.pingLoop(time.Duration(hs.PingInterval)*time.Millisecond, time.Duration(hs.PingTimeout)*time.Millisecond)
+			c.lk.Lock()
+			h := c.onOpen
+			c.lk.Unlock()
+			if h != nil {
+				c.dispatch(func() { h(hs) })
+			}
+
+		case Close:
+			return c.fail(ErrServerClosed)
+
+		case Ping:
+			c.write(&Packet{Type: Pong, Data: p.Data})
+
+		case Pong:
+			select {
+			case c.pongs <- struct{}{}:
+			default:
+			}
+
+		case Message:
+			if err := c.handleMessage(p); err != nil {
+				return c.fail(err)
+			}
+		}
+	}
+}
+
+func (c *Client) handleMessage(p *Packet) error {
+	switch p.MsgType {
+	case Event, BinaryEvent:
+		event, args, err := p.Event()
+		if err != nil {
+			return nil
+		}
+		c.lk.Lock()
+		h, ok := c.handlers[event]
+		fallback := c.onAny
+		c.lk.Unlock()
+		if ok {
+			c.dispatch(func() { h(args) })
+		} else if fallback != nil {
+			c.dispatch(func() { fallback(event, args) })
+		}
+		if p.AckID != NoAck {
+			// сервер ждёт подтверждения; отвечаем пустым
+			if ack, err := NewAck(p.AckID); err == nil {
+				c.write(ack)
+			}
+		}
+
+	case Ack, BinaryAck:
+		c.lk.Lock()
+		h, ok := c.acks[p.AckID]
+		delete(c.acks, p.AckID)
+		c.lk.Unlock()
+		if ok && h != nil {
+			args, _ := p.Args()
+			c.dispatch(func() { h(args) })
+		}
+
+	case Disconnect:
+		return ErrServerClosed
+
+	case Error:
+		return fmt.Errorf("socket.io error: %s", p.Data)
+	}
+	return nil
+}
+
+// pingLoop шлёт пинги и закрывает соединение, если понг не пришёл за timeout
+func (c *Client) pingLoop(interval, timeout time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	if timeout <= 0 {
+		timeout = interval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+		if err := c.write(&Packet{Type: Ping}); err != nil {
+			c.fail(err)
+			return
+		}
+		select {
+		case <-c.done:
+			return
+		case <-c.pongs:
+		case <-time.After(timeout):
+			c.fail(ErrPongTimeout)
+			return
+		}
+	}
+}
+
+// fail закрывает соединение; первая причина закрытия сохраняется
+func (c *Client) fail(err error) error {
+	c.closeOnce.Do(func() { c.shutdown(err, false) })
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	return c.err
+}
+
+func (c *Client) shutdown(err error, notify bool) {
+	c.lk.Lock()
+	c.err = err
+	c.lk.Unlock()
+	// причина записана раньше, чем сервер увидит Close и оборвёт соединение
+	if notify {
+		c.write(&Packet{Type: Close})
+	}
+	close(c.done)
+	c.conn.Close()
+}
+
+// Close закрывает соединение; Run вернёт ErrClosed
+func (c *Client) Close() error {
+	c.closeOnce.Do(func() { c.shutdown(ErrClosed, true) })
+	return nil
+}
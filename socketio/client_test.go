@@ -0,0 +1,294 @@
+package socketio
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const testTimeout = 5 * time.Second
+
+func startServer(t *testing.T, srv *Server) string {
+	t.Helper()
+	ts := httptest.NewServer(srv)
+	t.Cleanup(ts.Close)
+	return "ws" + strings.TrimPrefix(ts.URL, "http") + "/socket.io/"
+}
+
+// startRawServer — сервер, поведение которого целиком задаёт serve (например, не отвечающий на пинги)
+func startRawServer(t *testing.T, serve func(conn *websocket.Conn)) string {
+	t.Helper()
+	upgrader := websocket.Upgrader{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		serve(conn)
+	}))
+	t.Cleanup(ts.Close)
+	return "ws" + strings.TrimPrefix(ts.URL, "http") + "/socket.io/"
+}
+
+func sendOpen(conn *websocket.Conn, interval, timeout time.Duration) error {
+	hs, _ := json.Marshal(&Handshake{
+		SID:          "raw",
+		Upgrades:     []string{},
+		PingInterval: int(interval / time.Millisecond),
+		PingTimeout:  int(timeout / time.Millisecond),
+	})
+	return conn.WriteMessage(websocket.TextMessage, (&Packet{Type: Open, Data: hs}).Encode())
+}
+
+// run запускает Run клиента и возвращает канал с его результатом
+func run(c *Client) <-chan error {
+	ch := make(chan error, 1)
+	go func() { ch <- c.Run() }()
+	return ch
+}
+
+func waitErr(t *testing.T, ch <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-ch:
+		return err
+	case <-time.After(testTimeout):
+		t.Fatal("Run did not return")
+		return nil
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	query := make(chan string, 1)
+	url := startServer(t, &Server{
+		PingInterval: time.Second,
+		PingTimeout:  2 * time.Second,
+		Authorize: func(r *http.Request) int {
+			query <- r.URL.RawQuery
+			return 0
+		},
+	})
+
+	c, err := Dial(url+"?token=abc", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q := <-query; !strings.Contains(q, "EIO=3") || !strings.Contains(q, "transport=websocket") || !strings.Contains(q, "token=abc") {
+		t.Errorf("unexpected handshake query %q", q)
+	}
+
+	opened := make(chan Handshake, 1)
+	c.OnOpen(func(hs Handshake) { opened <- hs })
+	done := run(c)
+	select {
+	case hs := <-opened:
+		if hs.SID == "" || hs.PingInterval != 1000 || hs.PingTimeout != 2000 {
+			t.Errorf("unexpected handshake %+v", hs)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("no handshake")
+	}
+
+	c.Close()
+	if err := waitErr(t, done); err != ErrClosed {
+		t.Errorf("Run returned %v, want %v", err, ErrClosed)
+	}
+}
+
+func TestHandshakeRejected(t *testing.T) {
+	url := startServer(t, &Server{
+		Authorize: func(r *http.Request) int { return http.StatusUnauthorized },
+	})
+
+	_, err := Dial(url, nil)
+	he, ok := err.(*HandshakeError)
+	if !ok {
+		t.Fatalf("Dial returned %v, want HandshakeError", err)
+	}
+	if he.StatusCode != http.StatusUnauthorized {
+		t.Errorf("status %d, want %d", he.StatusCode, http.StatusUnauthorized)
+	}
+}
+
+func TestEventDispatch(t *testing.T) {
+	url := startServer(t, &Server{
+		PingInterval: time.Second,
+		PingTimeout:  time.Second,
+		OnConnect: func(c *ServerConn) {
+			c.Emit("known", "first")
+			c.Emit("other", "second")
+		},
+	})
+	c, err := Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(chan string, 2)
+	c.On("known", func(args []json.RawMessage) { got <- "known " + string(args[0]) })
+	c.OnAny(func(event string, args []json.RawMessage) { got <- event + " " + string(args[0]) })
+	done := run(c)
+	defer func() { c.Close(); waitErr(t, done) }()
+
+	for _, want := range []string{`known "first"`, `other "second"`} {
+		select {
+		case s := <-got:
+			if s != want {
+				t.Errorf("got event %s, want %s", s, want)
+			}
+		case <-time.After(testTimeout):
+			t.Fatalf("no event %s", want)
+		}
+	}
+}
+
+func TestAckIDs(t *testing.T) {
+	url := startServer(t, &Server{
+		PingInterval: time.Second,
+		PingTimeout:  time.Second,
+		OnEvent: func(c *ServerConn, event string, args []json.RawMessage) []interface{} {
+			return []interface{}{event + " " + string(args[0])}
+		},
+	})
+	c, err := Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := run(c)
+	defer func() { c.Close(); waitErr(t, done) }()
+
+	// подтверждения должны достаться тем, кто их запросил
+	acks := make([]chan string, 3)
+	for i := range acks {
+		ch := make(chan string, 1)
+		acks[i] = ch
+		if err := c.EmitAck("subscribe", func(args []json.RawMessage) {
+			var s string
+			json.Unmarshal(args[0], &s)
+			ch <- s
+		}, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, ch := range acks {
+		want := "subscribe " + string(rune('0'+i))
+		select {
+		case s := <-ch:
+			if s != want {
+				t.Errorf("ack %d got %q, want %q", i, s, want)
+			}
+		case <-time.After(testTimeout):
+			t.Fatalf("no ack %d", i)
+		}
+	}
+}
+
+// на событие, ждущее подтверждения, клиент отвечает пустым Ack с тем же ID
+func TestAckReply(t *testing.T) {
+	reply := make(chan *Packet, 1)
+	url := startRawServer(t, func(conn *websocket.Conn) {
+		sendOpen(conn, time.Second, time.Second)
+		p, _ := NewEvent("ping-me", 42, "x")
+		conn.WriteMessage(websocket.TextMessage, p.Encode())
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if p, err := ParsePacket(data); err == nil && p.Type == Message && p.MsgType == Ack {
+				reply <- p
+				return
+			}
+		}
+	})
+	c, err := Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := run(c)
+	defer func() { c.Close(); waitErr(t, done) }()
+
+	select {
+	case p := <-reply:
+		if p.AckID != 42 {
+			t.Errorf("ack ID %d, want 42", p.AckID)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("no ack reply")
+	}
+}
+
+func TestServerClose(t *testing.T) {
+	srv := &Server{PingInterval: time.Second, PingTimeout: time.Second}
+	url := startServer(t, srv)
+	c, err := Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened := make(chan struct{})
+	c.OnOpen(func(Handshake) { close(opened) })
+	done := run(c)
+	<-opened
+
+	srv.CloseAll()
+	if err := waitErr(t, done); err != ErrServerClosed {
+		t.Errorf("Run returned %v, want %v", err, ErrServerClosed)
+	}
+}
+
+func TestPongTimeout(t *testing.T) {
+	url := startRawServer(t, func(conn *websocket.Conn) {
+		sendOpen(conn, 20*time.Millisecond, 20*time.Millisecond)
+		// читаем пинги, но не отвечаем
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	})
+	c, err := Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := waitErr(t, run(c)); err != ErrPongTimeout {
+		t.Errorf("Run returned %v, want %v", err, ErrPongTimeout)
+	}
+}
+
+// медленный обработчик не должен мешать получать понги
+func TestSlowHandler(t *testing.T) {
+	const interval = 20 * time.Millisecond
+	url := startServer(t, &Server{
+		PingInterval: interval,
+		PingTimeout:  interval,
+		OnConnect:    func(c *ServerConn) { c.Emit("slow") },
+	})
+	c, err := Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handled := make(chan struct{})
+	c.On("slow", func([]json.RawMessage) {
+		time.Sleep(10 * interval)
+		close(handled)
+	})
+	done := run(c)
+
+	select {
+	case <-handled:
+	case err := <-done:
+		t.Fatalf("Run returned %v while handler was running", err)
+	case <-time.After(testTimeout):
+		t.Fatal("handler is not called")
+	}
+	c.Close()
+	if err := waitErr(t, done); err != ErrClosed {
+		t.Errorf("Run returned %v, want %v", err, ErrClosed)
+	}
+}
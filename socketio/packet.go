@@ -0,0 +1,158 @@
+// Package socketio реализует протокол socket.io v2 (engine.io v3) поверх websocket —
+// ровно то, что нужно для realtime-сервера FreeFeed.
+package socketio
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strconv"
+)
+
+// PacketType — тип пакета engine.io
+type PacketType int
+
+const (
+	Open PacketType = iota
+	Close
+	Ping
+	Pong
+	Message
+	Upgrade
+	Noop
+)
+
+// MessageType — тип сообщения socket.io внутри пакета Message
+type MessageType int
+
+const (
+	Connect MessageType = iota
+	Disconnect
+	Event
+	Ack
+	Error
+	BinaryEvent
+	BinaryAck
+)
+
+// NoAck — значение AckID пакета, не требующего подтверждения
+const NoAck = -1
+
+var ErrBadPacket = errors.New("Malformed socket.io packet")
+
+type Packet struct {
+	Type      PacketType
+	MsgType   MessageType // только для Type == Message
+	Namespace string      // пустой — пространство имён по умолчанию ("/")
+	AckID     int         // NoAck, если подтверждение не нужно
+	Data      []byte      // для Open — JSON с параметрами сессии, для Event и Ack — JSON-массив
+}
+
+// Handshake — параметры сессии из пакета Open
+type Handshake struct {
+	SID          string   `json:"sid"`
+	Upgrades     []string `json:"upgrades"`
+	PingInterval int      `json:"pingInterval"` // миллисекунды
+	PingTimeout  int      `json:"pingTimeout"`  // миллисекунды
+}
+
+func ParsePacket(data []byte) (*Packet, error) {
+	if len(data) == 0 || data[0] < '0' || data[0] > '6' {
+		return nil, ErrBadPacket
+	}
+	p := &Packet{Type: PacketType(data[0] - '0'), AckID: NoAck}
+	data = data[1:]
+	if p.Type != Message {
+		p.Data = data
+		return p, nil
+	}
+
+	if len(data) == 0 || data[0] < '0' || data[0] > '6' {
+		return nil, ErrBadPacket
+	}
+	p.MsgType = MessageType(data[0] - '0')
+	data = data[1:]
+
+	if len(data) > 0 && data[0] == '/' {
+		end := bytes.IndexByte(data, ',')
+		if end < 0 {
+			end = len(data)
+		}
+		p.Namespace = string(data[:end])
+		data = data[end:]
+		if len(data) > 0 {
+			data = data[1:]
+		}
+	}
+
+	digits := 0
+	for digits < len(data) && data[digits] >= '0' && data[digits] <= '9' {
+		digits++
+	}
+	if digits > 0 {
+		p.AckID, _ = strconv.Atoi(string(data[:digits]))
+	}
+	p.Data = data[digits:]
+	return p, nil
+}
+
+func (p *Packet) Encode() []byte {
+	buf := []byte{byte('0' + p.Type)}
+	if p.Type != Message {
+		return append(buf, p.Data...)
+	}
+	buf = append(buf, byte('0'+p.MsgType))
+	if p.Namespace != "" && p.Namespace != "/" {
+		buf = append(append(buf, p.Namespace...), ',')
+	}
+	if p.AckID != NoAck {
+		buf = strconv.AppendInt(buf, int64(p.AckID), 10)
+	}
+	return append(buf, p.Data...)
+}
+
+// NewEvent создаёт пакет события event с аргументами args
+func NewEvent(event string, ackID int, args ...interface{}) (*Packet, error) {
+	data, err := json.Marshal(append([]interface{}{event}, args...))
+	if err != nil {
+		return nil, err
+	}
+	return &Packet{Type: Message, MsgType: Event, AckID: ackID, Data: data}, nil
+}
+
+// NewAck создаёт подтверждение пакета с номером ackID
+func NewAck(ackID int, args ...interface{}) (*Packet, error) {
+	if args == nil {
+		args = []interface{}{}
+	}
+	data, err := json.Marshal(args)
+	if err != nil {
+		return nil, err
+	}
+	return &Packet{Type: Message, MsgType: Ack, AckID: ackID, Data: data}, nil
+}
+
+// Event разбирает пакет события на имя и аргументы
+func (p *Packet) Event() (event string, args []json.RawMessage, err error) {
+	if p.Type != Message || (p.MsgType != Event && p.MsgType != BinaryEvent) {
+		return "", nil, ErrBadPacket
+	}
+	if err := json.Unmarshal(p.Data, &args); err != nil || len(args) == 0 {
+		return "", nil, ErrBadPacket
+	}
+	if err := json.Unmarshal(args[0], &event); err != nil {
+		return "", nil, ErrBadPacket
+	}
+	return event, args[1:], nil
+}
+
+// Args разбирает аргументы подтверждения
+func (p *Packet) Args() (args []json.RawMessage, err error) {
+	if len(p.Data) == 0 {
+		return nil, nil
+	}
+	if err := json.Unmarshal(p.Data, &args); err != nil {
+		return nil, ErrBadPacket
+	}
+	return args, nil
+}
@@ -0,0 +1,177 @@
+package socketio
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Server — минимальный сервер socket.io (только websocket-транспорт).
+// Нужен, чтобы проверять клиента и бота локально, без настоящего сервера FreeFeed.
+type Server struct {
+	PingInterval time.Duration
+	PingTimeout  time.Duration
+
+	// Authorize решает, принять ли соединение; ненулевой код — HTTP-статус отказа
+	Authorize func(r *http.Request) (status int)
+	// OnConnect вызывается после отправки клиенту пакета Open
+	OnConnect func(c *ServerConn)
+	// OnEvent обрабатывает событие клиента; возвращённые значения уходят в подтверждение,
+	// если клиент его запросил
+	OnEvent func(c *ServerConn, event string, args []json.RawMessage) []interface{}
+
+	upgrader websocket.Upgrader
+	lk       sync.Mutex
+	conns    map[*ServerConn]bool
+	lastSID  int
+}
+
+type ServerConn struct {
+	Request *http.Request
+
+	srv     *Server
+	conn    *websocket.Conn
+	writeLk sync.Mutex
+	lk      sync.Mutex
+	rooms   map[string]bool
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.Authorize != nil {
+		if status := s.Authorize(r); status != 0 {
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+	}
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	s.lk.Lock()
+	if s.conns == nil {
+		s.conns = make(map[*ServerConn]bool)
+	}
+	s.lastSID++
+	sid := strconv.Itoa(s.lastSID)
+	c := &ServerConn{Request: r, srv: s, conn: conn, rooms: make(map[string]bool)}
+	s.conns[c] = true
+	s.lk.Unlock()
+
+	defer func() {
+		s.lk.Lock()
+		delete(s.conns, c)
+		s.lk.Unlock()
+		conn.Close()
+	}()
+
+	hs, _ := json.Marshal(&Handshake{
+		SID:          sid,
+		Upgrades:     []string{},
+		PingInterval: int(s.PingInterval / time.Millisecond),
+		PingTimeout:  int(s.PingTimeout / time.Millisecond),
+	})
+	if c.write(&Packet{Type: Open, Data: hs}) != nil {
+		return
+	}
+	c.write(&Packet{Type: Message, MsgType: Connect, AckID: NoAck})
+	if s.OnConnect != nil {
+		s.OnConnect(c)
+	}
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		p, err := ParsePacket(data)
+		if err != nil {
+			continue
+		}
+		switch p.Type {
+		case Ping:
+			c.write(&Packet{Type: Pong, Data: p.Data})
+		case Close:
+			return
+		case Message:
+			if p.MsgType != Event {
+				continue
+			}
+			event, args, err := p.Event()
+			if err != nil {
+				continue
+			}
+			var result []interface{}
+			if s.OnEvent != nil {
+				result = s.OnEvent(c, event, args)
+			}
+			if p.AckID != NoAck {
+				if ack, err := NewAck(p.AckID, result...); err == nil {
+					c.write(ack)
+				}
+			}
+		}
+	}
+}
+
+// Conns возвращает текущие соединения
+func (s *Server) Conns() []*ServerConn {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	out := make([]*ServerConn, 0, len(s.conns))
+	for c := range s.conns {
+		out = append(out, c)
+	}
+	return out
+}
+
+// EmitTo отправляет событие всем соединениям, подписанным на room
+func (s *Server) EmitTo(room string, event string, args ...interface{}) {
+	for _, c := range s.Conns() {
+		if c.InRoom(room) {
+			c.Emit(event, args...)
+		}
+	}
+}
+
+// CloseAll закрывает все соединения пакетом Close, как при перезапуске сервера
+func (s *Server) CloseAll() {
+	for _, c := range s.Conns() {
+		c.Close()
+	}
+}
+
+func (c *ServerConn) write(p *Packet) error {
+	c.writeLk.Lock()
+	defer c.writeLk.Unlock()
+	return c.conn.WriteMessage(websocket.TextMessage, p.Encode())
+}
+
+func (c *ServerConn) Emit(event string, args ...interface{}) error {
+	p, err := NewEvent(event, NoAck, args...)
+	if err != nil {
+		return err
+	}
+	return c.write(p)
+}
+
+func (c *ServerConn) Join(room string) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	c.rooms[room] = true
+}
+
+func (c *ServerConn) InRoom(room string) bool {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	return c.rooms[room]
+}
+
+func (c *ServerConn) Close() error {
+	c.write(&Packet{Type: Close})
+	return c.conn.Close()
+}
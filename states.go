@@ -2,6 +2,8 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
+	"log"
 	"strconv"
 
 	"github.com/boltdb/bolt"
@@ -11,30 +13,38 @@ import (
 type Action string
 
 const (
-	ActNothing     Action = ""
-	ActNewToken    Action = "new token"
-	ActComposePost Action = "new direct"
-	ActAddComment  Action = "add comment"
+	ActNothing       Action = ""
+	ActNewToken      Action = "new token"
+	ActComposePost   Action = "new direct"
+	ActAddComment    Action = "add comment"
+	ActConfirmDelete Action = "confirm delete"
 )
 
 var actionTitles = map[Action]string{
-	ActNothing:     "ничего",
-	ActNewToken:    "установка токена",
-	ActComposePost: "создание директ-сообщения",
-	ActAddComment:  "добавление комментария",
+	ActNothing:       "ничего",
+	ActNewToken:      "установка токена",
+	ActComposePost:   "создание директ-сообщения",
+	ActAddComment:    "добавление комментария",
+	ActConfirmDelete: "удаление сообщения",
 }
 
 type State struct {
 	stateBase
-	Addressees []string
-	PostAuthor string
-	PostID     string
+	Addressees  []string
+	PostAuthor  string
+	PostID      string
+	CommentID   string
+	AccountName string // аккаунт, от имени которого удаляется сообщение
+	Host        string // инстанс FreeFeed, для которого вводится токен, или инстанс аккаунта AccountName
 }
 
 type stateBase struct {
-	UserID TgUserID
-	Action Action
-	User   *frf.User
+	UserID     TgUserID
+	Action     Action
+	User       *frf.User   // активный аккаунт
+	Accounts   []*frf.User // все подключённые аккаунты, включая активный
+	ListOffset int         // откуда продолжать /list more
+	Paused     bool        // пользователь заблокировал бота, уведомления не присылаем
 }
 
 func (s *State) IsAuthorized() bool  { return s.User != nil }
@@ -45,22 +55,225 @@ func (s *State) Clone(act Action) *State {
 	return newState
 }
 
+// Имена аккаунтов уникальны только в пределах инстанса FreeFeed,
+// поэтому аккаунт определяется парой (хост, имя).
+
+// Account возвращает подключённый аккаунт name на инстансе host или nil
+func (s *State) Account(host, name string) *frf.User {
+	for _, u := range s.Accounts {
+		if u.Host == host && u.Name == name {
+			return u
+		}
+	}
+	return nil
+}
+
+// FindAccount ищет аккаунт по имени; host можно не указывать, если аккаунт с таким именем один.
+// ambiguous == true, если хост не указан, а аккаунтов с таким именем несколько.
+func (s *State) FindAccount(name, host string) (user *frf.User, ambiguous bool) {
+	if host != "" {
+		return s.Account(host, name), false
+	}
+	for _, u := range s.Accounts {
+		if u.Name == name {
+			if user != nil {
+				return nil, true
+			}
+			user = u
+		}
+	}
+	return user, false
+}
+
+func sameAccount(u1, u2 *frf.User) bool { return u1.Host == u2.Host && u1.Name == u2.Name }
+
+// AddAccount подключает аккаунт (или обновляет его токен) и делает его активным
+func (s *State) AddAccount(user *frf.User) {
+	accounts := []*frf.User{}
+	for _, u := range s.Accounts {
+		if !sameAccount(u, user) {
+			accounts = append(accounts, u)
+		}
+	}
+	s.Accounts = append(accounts, user)
+	s.User = user
+}
+
+// RemoveAccount отключает аккаунт. Если он был активным, активным становится первый из оставшихся.
+func (s *State) RemoveAccount(user *frf.User) {
+	accounts := []*frf.User{}
+	for _, u := range s.Accounts {
+		if !sameAccount(u, user) {
+			accounts = append(accounts, u)
+		}
+	}
+	s.Accounts = accounts
+	if s.User != nil && sameAccount(s.User, user) {
+		s.User = nil
+		if len(accounts) > 0 {
+			s.User = accounts[0]
+		}
+	}
+}
+
+// UseAccount делает активным аккаунт name на инстансе host
+func (s *State) UseAccount(host, name string) bool {
+	if u := s.Account(host, name); u != nil {
+		s.User = u
+		return true
+	}
+	return false
+}
+
+// IsActive сообщает, активен ли аккаунт user
+func (s *State) IsActive(user *frf.User) bool { return s.User != nil && sameAccount(s.User, user) }
+
+// записи, сохранённые до появления нескольких аккаунтов, содержат только User
+func (s *State) normalize() {
+	if s.User == nil {
+		return
+	}
+	if u := s.Account(s.User.Host, s.User.Name); u != nil {
+		s.User = u
+	} else {
+		s.Accounts = append(s.Accounts, s.User)
+	}
+}
+
+// setDefaultHost проставляет хост аккаунтам из записей, сохранённых до появления
+// нескольких инстансов: все они относятся к инстансу по умолчанию
+func (s *State) setDefaultHost(host string) {
+	for _, u := range s.Accounts {
+		if u.Host == "" {
+			u.Host = host
+		}
+	}
+}
+
+// decodeState разбирает запись из базы и расшифровывает токены ключом keys
+func decodeState(data []byte, state *State, keys *Keyring) error {
+	if err := json.Unmarshal(data, state); err != nil {
+		return err
+	}
+	for _, u := range append([]*frf.User{state.User}, state.Accounts...) {
+		if u == nil {
+			continue
+		}
+		token, err := keys.Open(u.AccessToken)
+		if err != nil {
+			return err
+		}
+		u.AccessToken = token
+	}
+	state.normalize()
+	return nil
+}
+
+// encodeState сериализует состояние для записи в базу, шифруя токены ключом keys (если он задан)
+func encodeState(state *State, keys *Keyring) ([]byte, error) {
+	if keys == nil {
+		return json.Marshal(state)
+	}
+	sealUser := func(u *frf.User) (*frf.User, error) {
+		if u == nil {
+			return nil, nil
+		}
+		token, err := keys.Seal(u.AccessToken)
+		if err != nil {
+			return nil, err
+		}
+		su := *u
+		su.AccessToken = token
+		return &su, nil
+	}
+
+	st := *state
+	var err error
+	if st.User, err = sealUser(state.User); err != nil {
+		return nil, err
+	}
+	st.Accounts = make([]*frf.User, len(state.Accounts))
+	for i, u := range state.Accounts {
+		if st.Accounts[i], err = sealUser(u); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(&st)
+}
+
 func (a *App) LoadState(userID TgUserID) *State {
 	state := new(State)
 	state.UserID = userID
 	a.db.View(func(tx *bolt.Tx) error {
 		data := tx.Bucket(StatesBucket).Get([]byte(strconv.FormatInt(userID, 10)))
-		return json.Unmarshal(data, state)
+		if data == nil {
+			return nil
+		}
+		if err := decodeState(data, state, a.keys); err != nil {
+			log.Println("Can not decode state of", userID, err)
+		}
+		return nil
 	})
+	state.setDefaultHost(a.apiHost)
 	return state
 }
 
 func (a *App) SaveState(state *State) {
 	a.db.Update(func(tx *bolt.Tx) error {
-		data, _ := json.Marshal(state)
-		tx.Bucket(StatesBucket).Put([]byte(strconv.FormatInt(state.UserID, 10)), data)
+		data, err := encodeState(state, a.keys)
+		if err != nil {
+			log.Println("Can not encode state of", state.UserID, err)
+			return err
+		}
+		return tx.Bucket(StatesBucket).Put([]byte(strconv.FormatInt(state.UserID, 10)), data)
+	})
+}
+
+// ReencryptStates перезаписывает токены во всех записях, зашифровывая их ключом newKeys.
+// Если all == false, перезаписываются только записи с незашифрованными токенами (миграция).
+// Возвращает количество перезаписанных записей.
+func (a *App) ReencryptStates(newKeys *Keyring, all bool) (count int, err error) {
+	err = a.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(StatesBucket)
+		updates := map[string][]byte{}
+		err := b.ForEach(func(k, v []byte) error {
+			state := new(State)
+			if err := decodeState(v, state, a.keys); err != nil {
+				return fmt.Errorf("state %s: %v", k, err)
+			}
+			if !all && (newKeys == nil || !hasPlainTokens(v)) {
+				return nil
+			}
+			data, err := encodeState(state, newKeys)
+			if err != nil {
+				return err
+			}
+			updates[string(k)] = data
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for k, data := range updates {
+			if err := b.Put([]byte(k), data); err != nil {
+				return err
+			}
+		}
+		count = len(updates)
 		return nil
 	})
+	return
+}
+
+func hasPlainTokens(data []byte) bool {
+	state := new(State)
+	json.Unmarshal(data, state)
+	for _, u := range append([]*frf.User{state.User}, state.Accounts...) {
+		if u != nil && !IsSealed(u.AccessToken) {
+			return true
+		}
+	}
+	return false
 }
 
 func (a *App) ResetState(state *State) *State {
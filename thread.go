@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/davidmz/FreefeedDirectBot/frf"
+)
+
+func (a *App) getThread(ctx context.Context, user *frf.User, postID string) (*frf.Post, error) {
+	return a.api(user).GetThread(ctx, postID)
+}
+
+// SendThread присылает пост со всеми комментариями в хронологическом порядке
+func (a *App) SendThread(ctx context.Context, state *State, postID string) {
+	post, err := a.getThread(ctx, state.User, postID)
+	if err != nil {
+		a.SendError(state.UserID, "Что-то пошло не так: %s", err)
+		return
+	}
+
+	me := state.User.Name
+	entries := []string{
+		"🧵 " + humanName(post.Author, me, "вы") + " → " + humanList(post.Addressees, me, "вам") + ":\n" +
+			separator + "\n" + post.Body,
+	}
+	for _, c := range post.Comments {
+		entries = append(entries, "💬 "+humanName(c.Author, me, "вы")+":\n"+c.Body)
+	}
+
+	footer := fmt.Sprintf("%s\nКомментариев: %d", separator, len(post.Comments))
+	// длинное обсуждение разобьётся на несколько сообщений в outbox
+	a.SendPost(state.UserID, state.User, strings.Join(entries, "\n\n")+"\n"+footer, post.Author, post.ID)
+}
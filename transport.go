@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"sync"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// BotTransport — то, чем бот пользуется из Telegram Bot API. Его реализует *tgbotapi.BotAPI,
+// а для проверки бота без Telegram — faketg.Bot.
+type BotTransport interface {
+	Send(c tgbotapi.Chattable) (tgbotapi.Message, error)
+	AnswerCallbackQuery(config tgbotapi.CallbackConfig) (tgbotapi.APIResponse, error)
+	AnswerInlineQuery(config tgbotapi.InlineConfig) (tgbotapi.APIResponse, error)
+	GetFileDirectURL(fileID string) (string, error)
+	GetChatMember(config tgbotapi.ChatConfigWithUser) (tgbotapi.ChatMember, error)
+	MakeRequest(endpoint string, params url.Values) (tgbotapi.APIResponse, error)
+}
+
+var _ BotTransport = (*tgbotapi.BotAPI)(nil)
+
+// Serve обрабатывает входящие обновления и передаёт исходящие сообщения в delivery.
+// Возвращается, когда ctx отменён и начатые обработчики обновлений закончили работу.
+func (a *App) Serve(ctx context.Context, updates <-chan Update, delivery *Delivery) {
+	var handlers sync.WaitGroup
+	for {
+		select {
+		case update := <-updates:
+			handlers.Add(1)
+			go func() {
+				defer handlers.Done()
+				a.HandleUpdate(update)
+			}()
+		case msg := <-a.outbox:
+			delivery.Push(msg)
+		case <-ctx.Done():
+			// новые обновления не принимаем, но ответы начатых обработчиков доставляем
+			finished := make(chan struct{})
+			go func() {
+				handlers.Wait()
+				close(finished)
+			}()
+			for {
+				select {
+				case msg := <-a.outbox:
+					delivery.Push(msg)
+				case <-finished:
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/url"
+	"strconv"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Update дополняет tgbotapi.Update типами обновлений, которых нет в библиотеке
+type Update struct {
+	tgbotapi.Update
+	MyChatMember *ChatMemberUpdated `json:"my_chat_member"`
+}
+
+// ChatMemberUpdated — изменение статуса бота в чате (например, пользователь заблокировал бота)
+type ChatMemberUpdated struct {
+	Chat          tgbotapi.Chat       `json:"chat"`
+	From          tgbotapi.User       `json:"from"`
+	Date          int                 `json:"date"`
+	OldChatMember tgbotapi.ChatMember `json:"old_chat_member"`
+	NewChatMember tgbotapi.ChatMember `json:"new_chat_member"`
+}
+
+var allowedUpdates = []string{"message", "edited_message", "callback_query", "inline_query", "my_chat_member"}
+
+// GetUpdatesChan — аналог tgbotapi.BotAPI.GetUpdatesChan, который запрашивает и разбирает
+// в том числе обновления, неизвестные библиотеке
+func GetUpdatesChan(bot BotTransport, timeout int) <-chan Update {
+	ch := make(chan Update, 100)
+	allowed, _ := json.Marshal(allowedUpdates)
+
+	go func() {
+		offset := 0
+		for {
+			v := url.Values{}
+			v.Set("offset", strconv.Itoa(offset))
+			v.Set("timeout", strconv.Itoa(timeout))
+			v.Set("allowed_updates", string(allowed))
+
+			resp, err := bot.MakeRequest("getUpdates", v)
+			if err != nil {
+				log.Println("Failed to get updates, retrying in 3 seconds:", err)
+				time.Sleep(3 * time.Second)
+				continue
+			}
+
+			var raws []json.RawMessage
+			if err := json.Unmarshal(resp.Result, &raws); err != nil {
+				log.Println("Can not decode updates, retrying in 3 seconds:", err)
+				time.Sleep(3 * time.Second)
+				continue
+			}
+
+			for _, raw := range raws {
+				// обновление, которое не удалось разобрать, пропускаем, но offset сдвигаем
+				// и за него, иначе Telegram будет присылать его снова и снова
+				var u Update
+				err := json.Unmarshal(raw, &u)
+				if err != nil {
+					id := &struct {
+						UpdateID int `json:"update_id"`
+					}{}
+					if json.Unmarshal(raw, id) != nil {
+						log.Println("Can not decode update:", err)
+						continue
+					}
+					log.Println("Can not decode update", id.UpdateID, ":", err)
+					u = Update{}
+					u.UpdateID = id.UpdateID
+				}
+				if u.UpdateID >= offset {
+					offset = u.UpdateID + 1
+					if err == nil {
+						ch <- u
+					}
+				}
+			}
+		}
+	}()
+
+	return ch
+}
+
+func (u *Update) Kind() string {
+	switch {
+	case u.Message != nil:
+		return "message"
+	case u.EditedMessage != nil:
+		return "edited_message"
+	case u.ChannelPost != nil:
+		return "channel_post"
+	case u.EditedChannelPost != nil:
+		return "edited_channel_post"
+	case u.InlineQuery != nil:
+		return "inline_query"
+	case u.ChosenInlineResult != nil:
+		return "chosen_inline_result"
+	case u.CallbackQuery != nil:
+		return "callback_query"
+	case u.ShippingQuery != nil:
+		return "shipping_query"
+	case u.PreCheckoutQuery != nil:
+		return "pre_checkout_query"
+	case u.MyChatMember != nil:
+		return "my_chat_member"
+	}
+	return "unknown"
+}
+
+// HandleUpdate направляет обновление соответствующему обработчику
+func (a *App) HandleUpdate(u Update) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Println("Panic while handling", u.Kind(), "update", u.UpdateID, ":", r)
+		}
+	}()
+
+	switch {
+	case u.Message != nil && u.Message.From != nil && isGroupChat(u.Message.Chat):
+		ctx, done := a.startOperation(TgUserID(u.Message.From.ID))
+		defer done()
+		a.HandleGroupMessage(ctx, u.Message)
+	case u.EditedMessage != nil && isGroupChat(u.EditedMessage.Chat):
+		// правки в группе во FreeFeed не переносятся
+		a.ignoreUpdate("group edited_message")
+	case u.Message != nil && u.Message.From != nil:
+		ctx, done := a.startOperation(TgUserID(u.Message.From.ID))
+		defer done()
+		a.HandleMessage(ctx, u.Message)
+	case u.EditedMessage != nil && u.EditedMessage.From != nil:
+		ctx, done := a.startOperation(TgUserID(u.EditedMessage.From.ID))
+		defer done()
+		a.HandleEditedMessage(ctx, u.EditedMessage)
+	case u.CallbackQuery != nil:
+		ctx, done := a.startOperation(TgUserID(u.CallbackQuery.From.ID))
+		defer done()
+		a.HandleCallback(ctx, u.CallbackQuery)
+	case u.InlineQuery != nil:
+		a.HandleInlineQuery(u.InlineQuery)
+	case u.MyChatMember != nil:
+		a.HandleMyChatMember(u.MyChatMember)
+	default:
+		a.ignoreUpdate(u.Kind())
+	}
+}
+
+func (a *App) ignoreUpdate(kind string) {
+	a.ignoredLk.Lock()
+	a.ignored[kind]++
+	cnt := a.ignored[kind]
+	a.ignoredLk.Unlock()
+	log.Println("Ignoring update of kind", kind, "(total:", cnt, ")")
+}
+
+// IgnoredUpdates возвращает количество проигнорированных обновлений по типам
+func (a *App) IgnoredUpdates() map[string]int {
+	a.ignoredLk.Lock()
+	defer a.ignoredLk.Unlock()
+	out := make(map[string]int, len(a.ignored))
+	for k, v := range a.ignored {
+		out[k] = v
+	}
+	return out
+}
+
+// Бот не работает в inline-режиме, поэтому просто отвечаем пустым списком
+func (a *App) HandleInlineQuery(q *tgbotapi.InlineQuery) {
+	a.bot.AnswerInlineQuery(tgbotapi.InlineConfig{InlineQueryID: q.ID, Results: []interface{}{}})
+}
+
+func (a *App) HandleMyChatMember(m *ChatMemberUpdated) {
+	log.Println("Bot status in chat", m.Chat.ID, "changed:", m.OldChatMember.Status, "->", m.NewChatMember.Status)
+	if m.Chat.Type == "private" && m.NewChatMember.Status == "kicked" {
+		a.PauseUser(TgUserID(m.Chat.ID))
+	}
+	if isGroupChat(&m.Chat) && (m.NewChatMember.Status == "left" || m.NewChatMember.Status == "kicked") {
+		a.DeleteGroup(m.Chat.ID)
+	}
+}